@@ -1,8 +1,12 @@
 package dbstate
 
 import (
+	"encoding/binary"
 	"github.com/bwmarrin/discordgo"
-	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+	"time"
 )
 
 // SelfUser returns the current user from the ready payload,
@@ -29,8 +33,21 @@ func (s *State) Guild(id string) (*discordgo.Guild, error) {
 }
 
 // GuildWithTx is the same as guild but allows you to pass a transaction
-func (s *State) GuildWithTxn(txn *badger.Txn, id string) (st *discordgo.Guild, err error) {
+func (s *State) GuildWithTxn(txn Txn, id string) (st *discordgo.Guild, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			st, err = s.GuildWithTxn(txn, id)
+			return err
+		})
+		return
+	}
+
 	_, err = s.GetKey(txn, KeyGuild(id), &st)
+	if err != nil {
+		return
+	}
+
+	err = s.fillGuild(txn, st)
 	return
 }
 
@@ -40,7 +57,7 @@ func (s *State) GuildMember(guildID, userID string) (*discordgo.Member, error) {
 }
 
 // GuildMemberWithTxn is the same as GuildMember but allows you to pass a transaction
-func (s *State) GuildMemberWithTxn(txn *badger.Txn, guildID, userID string) (st *discordgo.Member, err error) {
+func (s *State) GuildMemberWithTxn(txn Txn, guildID, userID string) (st *discordgo.Member, err error) {
 	_, err = s.GetKey(txn, KeyGuildMember(guildID, userID), &st)
 	return
 }
@@ -51,7 +68,7 @@ func (s *State) Channel(channelID string) (*discordgo.Channel, error) {
 }
 
 // ChannelWithTxn is the same as channel but allows you to pass a transaction
-func (s *State) ChannelWithTxn(txn *badger.Txn, channelID string) (st *discordgo.Channel, err error) {
+func (s *State) ChannelWithTxn(txn Txn, channelID string) (st *discordgo.Channel, err error) {
 	_, err = s.GetKey(txn, KeyChannel(channelID), &st)
 	return
 }
@@ -64,13 +81,14 @@ func (s *State) ChannelMessage(channelID, messageID string) (st *discordgo.Messa
 // MessageWithMeta includes some  message meta with a message
 type MessageWithMeta struct {
 	*discordgo.Message
-	Deleted bool
+	Deleted     bool
+	BulkDeleted bool
 }
 
 // ChannelMessageWithTxn is the same as ChannelMessage but allows you to pass a transaction
 // Check flags against MessageFlag
-func (s *State) ChannelMessageWithTxn(txn *badger.Txn, channelID, messageID string) (st *discordgo.Message, flags MessageFlag, err error) {
-	var item *badger.Item
+func (s *State) ChannelMessageWithTxn(txn Txn, channelID, messageID string) (st *discordgo.Message, flags MessageFlag, err error) {
+	var item Item
 	item, err = s.GetKey(txn, KeyChannelMessage(channelID, messageID), &st)
 	if err == nil {
 		flags = MessageFlag(item.UserMeta())
@@ -84,7 +102,7 @@ func (s *State) LastChannelMessages(channelID string, n int, includeDeleted bool
 }
 
 // LastChannelMessages returns the last messages in a channel, if n <= 0 then it will return all messages
-func (s *State) LastChannelMessagesWithTxn(txn *badger.Txn, channelID string, n int, includeDeleted bool) (messages []*MessageWithMeta, err error) {
+func (s *State) LastChannelMessagesWithTxn(txn Txn, channelID string, n int, includeDeleted bool) (messages []*MessageWithMeta, err error) {
 
 	if n < 0 {
 		messages = make([]*MessageWithMeta, 0, 100)
@@ -100,8 +118,9 @@ func (s *State) LastChannelMessagesWithTxn(txn *badger.Txn, channelID string, n
 		}
 
 		messages = append(messages, &MessageWithMeta{
-			Deleted: deleted,
-			Message: m,
+			Deleted:     deleted,
+			BulkDeleted: flags&MessageFlagBulkDeleted != 0,
+			Message:     m,
 		})
 
 		if n > 0 && len(messages) >= n {
@@ -114,13 +133,123 @@ func (s *State) LastChannelMessagesWithTxn(txn *badger.Txn, channelID string, n
 	return
 }
 
+// ChannelMessagesBetween returns the messages in the channel sent between from (inclusive) and to (exclusive), oldest first
+// The range is computed from the snowflakes of the message ids, messages deleted with KeepDeletedMessages are included with the Deleted field set
+func (s *State) ChannelMessagesBetween(channelID string, from, to time.Time) ([]*MessageWithMeta, error) {
+	return s.ChannelMessagesBetweenWithTxn(nil, channelID, from, to)
+}
+
+// ChannelMessagesBetweenWithTxn is the same as ChannelMessagesBetween but allows you to pass a transaction
+func (s *State) ChannelMessagesBetweenWithTxn(txn Txn, channelID string, from, to time.Time) ([]*MessageWithMeta, error) {
+	return s.channelMessagesRange(txn, channelID, SnowflakeFromTime(from), SnowflakeFromTime(to), false, 0)
+}
+
+// ChannelMessagesBefore returns up to n messages in the channel sent before messageID, newest first, if n <= 0 then it will return all of them
+// Messages deleted with KeepDeletedMessages are included with the Deleted field set
+func (s *State) ChannelMessagesBefore(channelID, messageID string, n int) ([]*MessageWithMeta, error) {
+	return s.ChannelMessagesBeforeWithTxn(nil, channelID, messageID, n)
+}
+
+// ChannelMessagesBeforeWithTxn is the same as ChannelMessagesBefore but allows you to pass a transaction
+func (s *State) ChannelMessagesBeforeWithTxn(txn Txn, channelID, messageID string, n int) ([]*MessageWithMeta, error) {
+	parsed, err := strconv.ParseUint(messageID, 10, 64)
+	if err != nil {
+		return nil, errors.WithMessage(err, "messageID")
+	}
+
+	return s.channelMessagesRange(txn, channelID, 0, parsed, true, n)
+}
+
+// ChannelMessagesAfter returns up to n messages in the channel sent after messageID, oldest first, if n <= 0 then it will return all of them
+// Messages deleted with KeepDeletedMessages are included with the Deleted field set
+func (s *State) ChannelMessagesAfter(channelID, messageID string, n int) ([]*MessageWithMeta, error) {
+	return s.ChannelMessagesAfterWithTxn(nil, channelID, messageID, n)
+}
+
+// ChannelMessagesAfterWithTxn is the same as ChannelMessagesAfter but allows you to pass a transaction
+func (s *State) ChannelMessagesAfterWithTxn(txn Txn, channelID, messageID string, n int) ([]*MessageWithMeta, error) {
+	parsed, err := strconv.ParseUint(messageID, 10, 64)
+	if err != nil {
+		return nil, errors.WithMessage(err, "messageID")
+	}
+
+	// parsed+1 would wrap around to 0
+	if parsed == math.MaxUint64 {
+		return nil, nil
+	}
+
+	return s.channelMessagesRange(txn, channelID, parsed+1, math.MaxUint64, false, n)
+}
+
+// channelMessagesRange returns up to n of the messages in the channel with ids in the range [from, to)
+// seeking directly to the start of the range, as the keys are sorted by the message ids
+func (s *State) channelMessagesRange(txn Txn, channelID string, from, to uint64, newestFirst bool, n int) (messages []*MessageWithMeta, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			messages, err = s.channelMessagesRange(txn, channelID, from, to, newestFirst, n)
+			return err
+		})
+		return
+	}
+
+	if from >= to {
+		return nil, nil
+	}
+
+	prefix := KeyChannelMessageIteratorPrefix(channelID)
+	seek := make([]byte, 17)
+	copy(seek, prefix)
+
+	opts := DefaultIteratorOptions
+	if newestFirst {
+		opts.Reverse = true
+		binary.BigEndian.PutUint64(seek[9:], to-1)
+	} else {
+		binary.BigEndian.PutUint64(seek[9:], from)
+	}
+
+	it := txn.NewIterator(opts)
+	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+
+		id := binary.BigEndian.Uint64(item.Key()[9:])
+		if id < from || id >= to {
+			break
+		}
+
+		v, err := item.Value()
+		if err != nil {
+			return nil, err
+		}
+
+		var m *discordgo.Message
+		err = s.DecodeData(v, &m)
+		if err != nil {
+			return nil, err
+		}
+
+		flags := MessageFlag(item.UserMeta())
+		messages = append(messages, &MessageWithMeta{
+			Message:     m,
+			Deleted:     flags&MessageFlagDeleted != 0,
+			BulkDeleted: flags&MessageFlagBulkDeleted != 0,
+		})
+
+		if n > 0 && len(messages) >= n {
+			break
+		}
+	}
+
+	return messages, nil
+}
+
 // Presence returns a presence from state
 func (s *State) Presence(userID string) (st *discordgo.Presence, err error) {
 	return s.PresenceWithTxn(nil, userID)
 }
 
 // PresenceWithTxn is the same as presence but allows you to pass a transaction
-func (s *State) PresenceWithTxn(txn *badger.Txn, userID string) (st *discordgo.Presence, err error) {
+func (s *State) PresenceWithTxn(txn Txn, userID string) (st *discordgo.Presence, err error) {
 	_, err = s.GetKey(txn, KeyPresence(userID), &st)
 	return
 }
@@ -131,7 +260,7 @@ func (s *State) VoiceState(guildID, userID string) (st *discordgo.VoiceState, er
 }
 
 // VoiceStateWithTxn is the same as VoiceState but allows you to pass a transaction
-func (s *State) VoiceStateWithTxn(txn *badger.Txn, guildID, userID string) (st *discordgo.VoiceState, err error) {
+func (s *State) VoiceStateWithTxn(txn Txn, guildID, userID string) (st *discordgo.VoiceState, err error) {
 	_, err = s.GetKey(txn, KeyVoiceState(guildID, userID), &st)
 	return
 }
@@ -238,26 +367,27 @@ func (s *State) MemberPermissions(g *discordgo.Guild, channelID string, memberID
 // Guild retrieves a guild form the state
 // Note that members and presences will not be included in this
 // and will have to be queried seperately
-func (w *shardWorker) guild(txn *badger.Txn, id string) (st *discordgo.Guild, err error) {
+// Unlike State.Guild the roles, emojis and channels are not included either, see State.fillGuild
+func (w *shardWorker) guild(txn Txn, id string) (st *discordgo.Guild, err error) {
 	_, w.decodeBuffer, err = w.State.GetKeyWithBuffer(txn, KeyGuild(id), w.decodeBuffer, &st)
 	return
 }
 
 // GuildMember returns a member from the state
-func (w *shardWorker) guildMember(txn *badger.Txn, guildID, userID string) (st *discordgo.Member, err error) {
+func (w *shardWorker) guildMember(txn Txn, guildID, userID string) (st *discordgo.Member, err error) {
 	_, w.decodeBuffer, err = w.State.GetKeyWithBuffer(txn, KeyGuildMember(guildID, userID), w.decodeBuffer, &st)
 	return
 }
 
 // Channel returns a guild channel or private channel from state
-func (w *shardWorker) channel(txn *badger.Txn, channelID string) (st *discordgo.Channel, err error) {
+func (w *shardWorker) channel(txn Txn, channelID string) (st *discordgo.Channel, err error) {
 	_, w.decodeBuffer, err = w.State.GetKeyWithBuffer(txn, KeyChannel(channelID), w.decodeBuffer, &st)
 	return
 }
 
 // ChannelMessage returns a message from state
-func (w *shardWorker) channelMessage(txn *badger.Txn, channelID, messageID string) (st *discordgo.Message, flags MessageFlag, err error) {
-	var item *badger.Item
+func (w *shardWorker) channelMessage(txn Txn, channelID, messageID string) (st *discordgo.Message, flags MessageFlag, err error) {
+	var item Item
 	item, w.decodeBuffer, err = w.State.GetKeyWithBuffer(txn, KeyChannelMessage(channelID, messageID), w.decodeBuffer, &st)
 	if err == nil {
 		flags = MessageFlag(item.UserMeta())
@@ -265,14 +395,25 @@ func (w *shardWorker) channelMessage(txn *badger.Txn, channelID, messageID strin
 	return
 }
 
+// channelMessageItem returns the message and its item, for keeping the flags and expiry of the message when it's rewritten
+// the message is nil if it's not in state
+func (w *shardWorker) channelMessageItem(txn Txn, channelID, messageID string) (msg *discordgo.Message, item Item, err error) {
+	item, w.decodeBuffer, err = w.State.GetKeyWithBuffer(txn, KeyChannelMessage(channelID, messageID), w.decodeBuffer, &msg)
+	if err == ErrNotFound {
+		return nil, nil, nil
+	}
+
+	return
+}
+
 // Presence returns a presence from state
-func (w *shardWorker) presence(txn *badger.Txn, userID string) (st *discordgo.Presence, err error) {
+func (w *shardWorker) presence(txn Txn, userID string) (st *discordgo.Presence, err error) {
 	_, w.decodeBuffer, err = w.State.GetKeyWithBuffer(txn, KeyPresence(userID), w.decodeBuffer, &st)
 	return
 }
 
 // VoiceState returns a VoiceState from state
-func (w *shardWorker) voiceState(txn *badger.Txn, guildID, userID string) (st *discordgo.VoiceState, err error) {
+func (w *shardWorker) voiceState(txn Txn, guildID, userID string) (st *discordgo.VoiceState, err error) {
 	_, w.decodeBuffer, err = w.State.GetKeyWithBuffer(txn, KeyVoiceState(guildID, userID), w.decodeBuffer, &st)
 	return
 }
@@ -0,0 +1,120 @@
+package dbstate
+
+import (
+	"encoding/binary"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+)
+
+// UnavailableGuilds returns the ids of the guilds that are currently unavailable
+// This includes the guilds from the ready payload that a GuildCreate has not been received for yet
+func (s *State) UnavailableGuilds() (guilds []string, err error) {
+	err = s.Store.View(func(txn Txn) error {
+		prefix := []byte{byte(KeyTypeGuildUnavailable)}
+
+		opts := DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			guilds = append(guilds, strconv.FormatUint(binary.BigEndian.Uint64(key[1:]), 10))
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// GuildUnavailable marks a guild as unavailable (e.g during an outage), the data belonging to it is kept
+// If the guild is not in state (e.g the guilds in the ready payload) it's only marked as unavailable, it's not added to the state
+func (w *shardWorker) GuildUnavailable(g *discordgo.Guild) error {
+	return w.update(func(txn Txn) error {
+		err := txn.Set(KeyGuildUnavailable(g.ID), []byte{})
+		if err != nil {
+			return err
+		}
+
+		current, err := w.guild(txn, g.ID)
+		if err != nil {
+			if err == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+
+		if w.trackChanges() {
+			err = w.State.fillGuild(txn, current)
+			if err != nil {
+				return err
+			}
+		}
+
+		old := *current
+		current.Unavailable = true
+		w.addChange(&GuildChange{GuildID: g.ID, Old: &old, New: current})
+
+		return w.setGuild(txn, current)
+	})
+}
+
+// mergeGuildCreate merges the stored guild into g from a GuildCreate, g is authoritative
+// but fields missing from it are kept from the stored guild, and the channels and voice states
+// that were removed while the guild was unavailable are removed from state
+func (w *shardWorker) mergeGuildCreate(txn Txn, g, stored *discordgo.Guild) error {
+	if g.Roles == nil {
+		g.Roles = stored.Roles
+	}
+	if g.Emojis == nil {
+		g.Emojis = stored.Emojis
+	}
+	if g.MemberCount == 0 {
+		g.MemberCount = stored.MemberCount
+	}
+	if g.JoinedAt == "" {
+		g.JoinedAt = stored.JoinedAt
+	}
+
+	if g.Channels == nil {
+		g.Channels = stored.Channels
+	} else {
+	OUTER:
+		for _, c := range stored.Channels {
+			for _, v := range g.Channels {
+				if v.ID == c.ID {
+					continue OUTER
+				}
+			}
+
+			err := w.ChannelDelete(txn, c.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var left []*discordgo.VoiceState
+	err := w.State.IterateGuildVoiceStates(txn, g.ID, func(vs *discordgo.VoiceState) bool {
+		for _, v := range g.VoiceStates {
+			if v.UserID == vs.UserID {
+				return true
+			}
+		}
+
+		left = append(left, vs)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, vs := range left {
+		vs.ChannelID = ""
+		err = w.VoiceStateUpdate(txn, vs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
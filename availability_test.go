@@ -0,0 +1,93 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"testing"
+)
+
+func TestGuildUnavailable(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:         NewMemoryStore(),
+		TrackMembers:  true,
+		TrackChannels: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	g := &discordgo.Guild{
+		ID:          "1",
+		Name:        "outage",
+		MemberCount: 1,
+		Roles:       []*discordgo.Role{{ID: "100", Name: "role"}},
+		Channels: []*discordgo.Channel{
+			{ID: "10", GuildID: "1", Type: discordgo.ChannelTypeGuildText},
+			{ID: "11", GuildID: "1", Type: discordgo.ChannelTypeGuildText},
+		},
+		Members:     []*discordgo.Member{{User: &discordgo.User{ID: "5", Username: "bob"}}},
+		VoiceStates: []*discordgo.VoiceState{{UserID: "5", ChannelID: "20"}},
+	}
+
+	// The guilds from the ready payload are unavailable
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "2", Unavailable: true}}), "failed handling guild create")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: g}), "failed handling guild create")
+
+	unavailable, err := state.UnavailableGuilds()
+	AssertFatal(t, err, "failed retrieving unavailable guilds")
+	if len(unavailable) != 1 || unavailable[0] != "2" {
+		t.Fatalf("unexpected unavailable guilds: %v", unavailable)
+	}
+
+	// Only marked as unavailable, the guild is not in state until the GuildCreate
+	if _, err = state.Guild("2"); err != ErrNotFound {
+		t.Error("unavailable guild from the ready payload added to the state: ", err)
+	}
+	if n, _ := state.CountGuilds(); n != 1 {
+		t.Errorf("unexpected number of guilds: %d", n)
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildDelete{Guild: &discordgo.Guild{ID: "1", Unavailable: true}}), "failed handling guild delete")
+
+	stored, err := state.Guild("1")
+	AssertFatal(t, err, "guild removed on an unavailable guild delete")
+	if !stored.Unavailable || stored.Name != "outage" || len(stored.Roles) != 1 {
+		t.Errorf("unexpected unavailable guild: %#v", stored)
+	}
+
+	unavailable, err = state.UnavailableGuilds()
+	AssertFatal(t, err, "failed retrieving unavailable guilds")
+	if len(unavailable) != 2 {
+		t.Fatalf("unexpected unavailable guilds: %v", unavailable)
+	}
+
+	// The guild comes back with a channel and the voice state removed, and without roles
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{
+		ID:       "1",
+		Name:     "back",
+		Channels: []*discordgo.Channel{{ID: "10", GuildID: "1", Type: discordgo.ChannelTypeGuildText}},
+	}}), "failed handling guild create")
+
+	stored, err = state.Guild("1")
+	AssertFatal(t, err, "failed retrieving guild")
+	if stored.Unavailable || stored.Name != "back" {
+		t.Errorf("guild not updated: %#v", stored)
+	}
+	if len(stored.Roles) != 1 || stored.MemberCount != 1 {
+		t.Errorf("guild not merged: %#v", stored)
+	}
+
+	if _, err = state.Channel("11"); err != ErrNotFound {
+		t.Error("removed channel still in state: ", err)
+	}
+	if _, err = state.GuildMember("1", "5"); err != nil {
+		t.Error("member removed after the guild became available: ", err)
+	}
+	if n, _ := state.VoiceChannelMemberCount("20"); n != 0 {
+		t.Errorf("stale voice state kept, %d members in voice channel", n)
+	}
+
+	unavailable, err = state.UnavailableGuilds()
+	AssertFatal(t, err, "failed retrieving unavailable guilds")
+	if len(unavailable) != 1 || unavailable[0] != "2" {
+		t.Fatalf("unexpected unavailable guilds: %v", unavailable)
+	}
+}
@@ -0,0 +1,328 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"sync"
+	"sync/atomic"
+)
+
+// Change is a mutation of the state, passed to the subscribers (see State.Subscribe)
+//
+// The concrete types are GuildChange, MemberChange, ChannelChange, RoleChange, EmojisChange,
+// MessageChange, PresenceChange and VoiceStateChange.
+// In all of them Old is nil if the object was created, and New is nil if it was deleted
+type Change interface {
+	// changeInfo returns the type of object that changed and the guild it belongs to
+	changeInfo() (keyType KeyType, guildID string)
+}
+
+type GuildChange struct {
+	GuildID  string
+	Old, New *discordgo.Guild
+}
+
+func (c *GuildChange) changeInfo() (KeyType, string) {
+	return KeyTypeGuild, c.GuildID
+}
+
+type MemberChange struct {
+	GuildID  string
+	UserID   string
+	Old, New *discordgo.Member
+}
+
+func (c *MemberChange) changeInfo() (KeyType, string) {
+	return KeyTypeMember, c.GuildID
+}
+
+// ChannelChange is a change to a channel, GuildID is empty for private channels
+type ChannelChange struct {
+	GuildID   string
+	ChannelID string
+	Old, New  *discordgo.Channel
+}
+
+func (c *ChannelChange) changeInfo() (KeyType, string) {
+	return KeyTypeChannel, c.GuildID
+}
+
+// RoleChange is a change to a role
+type RoleChange struct {
+	GuildID  string
+	RoleID   string
+	Old, New *discordgo.Role
+}
+
+func (c *RoleChange) changeInfo() (KeyType, string) {
+	return KeyTypeGuildRole, c.GuildID
+}
+
+// EmojisChange is a change to the emojis of a guild, Old and New are the full emoji lists
+// Added, Removed and Renamed is the diff between them, Renamed holds the renamed emojis as they are in New
+type EmojisChange struct {
+	GuildID  string
+	Old, New []*discordgo.Emoji
+
+	Added, Removed, Renamed []*discordgo.Emoji
+}
+
+func (c *EmojisChange) changeInfo() (KeyType, string) {
+	return KeyTypeGuildEmoji, c.GuildID
+}
+
+// newEmojisChange returns a EmojisChange with the diff between old and new filled in
+func newEmojisChange(guildID string, old, new []*discordgo.Emoji) *EmojisChange {
+	c := &EmojisChange{GuildID: guildID, Old: old, New: new}
+
+OUTER:
+	for _, n := range new {
+		for _, o := range old {
+			if o.ID == n.ID {
+				if o.Name != n.Name {
+					c.Renamed = append(c.Renamed, n)
+				}
+				continue OUTER
+			}
+		}
+
+		c.Added = append(c.Added, n)
+	}
+
+OUTER2:
+	for _, o := range old {
+		for _, n := range new {
+			if o.ID == n.ID {
+				continue OUTER2
+			}
+		}
+
+		c.Removed = append(c.Removed, o)
+	}
+
+	return c
+}
+
+// MessageChange is a change to a message, New is also nil if the message was deleted with KeepDeletedMessages enabled
+// GuildID is empty for messages in private channels
+type MessageChange struct {
+	GuildID   string
+	ChannelID string
+	MessageID string
+	Old, New  *discordgo.Message
+}
+
+func (c *MessageChange) changeInfo() (KeyType, string) {
+	return KeyTypeChannelMessage, c.GuildID
+}
+
+// PresenceChange is a change to a presence, presences are global so it has no guild
+type PresenceChange struct {
+	UserID   string
+	Old, New *discordgo.Presence
+}
+
+func (c *PresenceChange) changeInfo() (KeyType, string) {
+	return KeyTypePresence, ""
+}
+
+type VoiceStateChange struct {
+	GuildID  string
+	UserID   string
+	Old, New *discordgo.VoiceState
+}
+
+func (c *VoiceStateChange) changeInfo() (KeyType, string) {
+	return KeyTypeVoiceState, c.GuildID
+}
+
+// SubscriptionFilter limits which changes a subscriber receives, empty fields match everything
+// Changes without a guild (presences and private channels/messages) never match a filter with GuildIDs set
+type SubscriptionFilter struct {
+	KeyTypes []KeyType
+	GuildIDs []string
+}
+
+func (f *SubscriptionFilter) matches(keyType KeyType, guildID string) bool {
+	if len(f.KeyTypes) > 0 {
+		found := false
+		for _, v := range f.KeyTypes {
+			if v == keyType {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.GuildIDs) > 0 {
+		for _, v := range f.GuildIDs {
+			if v == guildID {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+type subscription struct {
+	filter SubscriptionFilter
+	fn     func(c Change)
+}
+
+// subscriptions keeps track of the change subscribers
+type subscriptions struct {
+	sync.RWMutex
+	subs []*subscription
+
+	// Number of subscribers, so the workers can quickly check if they need to keep track of changes
+	count int32
+}
+
+// Subscribe registers fn to be called with every change to the state matching filter, after it has been committed
+//
+// fn is called from the shard worker that made the change before it moves on to the next event,
+// so it should not block for long and it must not modify the objects in the change
+// The returned function removes the subscription
+func (s *State) Subscribe(filter SubscriptionFilter, fn func(c Change)) (unsubscribe func()) {
+	sub := &subscription{
+		filter: filter,
+		fn:     fn,
+	}
+
+	s.subscriptions.Lock()
+	s.subscriptions.subs = append(s.subscriptions.subs, sub)
+	atomic.StoreInt32(&s.subscriptions.count, int32(len(s.subscriptions.subs)))
+	s.subscriptions.Unlock()
+
+	return func() {
+		s.subscriptions.Lock()
+		for i, v := range s.subscriptions.subs {
+			if v == sub {
+				s.subscriptions.subs = append(s.subscriptions.subs[:i], s.subscriptions.subs[i+1:]...)
+				break
+			}
+		}
+		atomic.StoreInt32(&s.subscriptions.count, int32(len(s.subscriptions.subs)))
+		s.subscriptions.Unlock()
+	}
+}
+
+func (s *State) dispatchChanges(changes []Change) {
+	// The callbacks are called without holding the lock, so that they can subscribe and unsubscribe
+	s.subscriptions.RLock()
+	subs := make([]*subscription, len(s.subscriptions.subs))
+	copy(subs, s.subscriptions.subs)
+	s.subscriptions.RUnlock()
+
+	for _, c := range changes {
+		keyType, guildID := c.changeInfo()
+		for _, sub := range subs {
+			if sub.filter.matches(keyType, guildID) {
+				sub.fn(c)
+			}
+		}
+	}
+}
+
+// trackChanges returns true if the worker should keep track of the changes it makes
+// if not then the old values does not need to be retrieved
+func (w *shardWorker) trackChanges() bool {
+	return w.captureChanges || atomic.LoadInt32(&w.State.subscriptions.count) > 0
+}
+
+// addChange adds a change made in the current transaction, it will be dispatched once the transaction has been committed
+func (w *shardWorker) addChange(c Change) {
+	if w.trackChanges() {
+		w.pendingChanges = append(w.pendingChanges, c)
+	}
+}
+
+// update runs fn in a transaction using RetryUpdate, dispatching the changes made in it once it's been committed
+func (w *shardWorker) update(fn func(txn Txn) error) error {
+	err := w.State.RetryUpdate(func(txn Txn) error {
+		// Throw away the changes from previous attempts
+		w.pendingChanges = w.pendingChanges[:0]
+		return fn(txn)
+	})
+
+	changes := w.pendingChanges
+	w.pendingChanges = w.pendingChanges[:0]
+
+	if err != nil || len(changes) < 1 {
+		return err
+	}
+
+	if w.captureChanges {
+		w.capturedChanges = append(w.capturedChanges, changes...)
+	}
+
+	w.State.dispatchChanges(changes)
+	return nil
+}
+
+// EventResult is returned by HandleEventMutexSyncedResult and contains the changes made by the event
+type EventResult struct {
+	// The changes in the order they were made, only changes that were committed are included
+	Changes []Change
+}
+
+// OldMessage returns the message as it was before the event, nil if it was not in state
+func (r *EventResult) OldMessage() *discordgo.Message {
+	for _, v := range r.Changes {
+		if c, ok := v.(*MessageChange); ok {
+			return c.Old
+		}
+	}
+
+	return nil
+}
+
+// OldMember returns the member as it was before the event, nil if it was not in state
+func (r *EventResult) OldMember() *discordgo.Member {
+	for _, v := range r.Changes {
+		if c, ok := v.(*MemberChange); ok {
+			return c.Old
+		}
+	}
+
+	return nil
+}
+
+// OldChannel returns the channel as it was before the event, nil if it was not in state
+func (r *EventResult) OldChannel() *discordgo.Channel {
+	for _, v := range r.Changes {
+		if c, ok := v.(*ChannelChange); ok {
+			return c.Old
+		}
+	}
+
+	return nil
+}
+
+// OldGuild returns the guild as it was before the event, nil if it was not in state
+func (r *EventResult) OldGuild() *discordgo.Guild {
+	for _, v := range r.Changes {
+		if c, ok := v.(*GuildChange); ok {
+			return c.Old
+		}
+	}
+
+	return nil
+}
+
+// EmojisChange returns the change to the emojis of the guild, nil if the event did not change them
+func (r *EventResult) EmojisChange() *EmojisChange {
+	for _, v := range r.Changes {
+		if c, ok := v.(*EmojisChange); ok {
+			return c
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:         NewMemoryStore(),
+		TrackMembers:  true,
+		TrackChannels: true,
+		TrackMessages: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	var changes []Change
+	unsub := state.Subscribe(SubscriptionFilter{GuildIDs: []string{"1"}}, func(c Change) {
+		changes = append(changes, c)
+	})
+
+	var memberChanges []Change
+	state.Subscribe(SubscriptionFilter{KeyTypes: []KeyType{KeyTypeMember}}, func(c Change) {
+		memberChanges = append(memberChanges, c)
+	})
+
+	w := state.shards[0]
+	AssertFatal(t, w.GuildCreate(&discordgo.Guild{ID: "1", Channels: []*discordgo.Channel{{ID: "10", Type: discordgo.ChannelTypeGuildText}}}), "failed creating guild")
+	AssertFatal(t, w.GuildCreate(&discordgo.Guild{ID: "2"}), "failed creating guild")
+
+	// Guild and channel
+	if len(changes) != 2 {
+		t.Fatalf("unexpected number of changes after guild create: %d", len(changes))
+	}
+	changes = nil
+
+	// Roles and emojis have their own key types and don't reach guild subscribers
+	var roleEmojiChanges []Change
+	state.Subscribe(SubscriptionFilter{KeyTypes: []KeyType{KeyTypeGuildRole, KeyTypeGuildEmoji}}, func(c Change) {
+		roleEmojiChanges = append(roleEmojiChanges, c)
+	})
+
+	var guildChanges []Change
+	state.Subscribe(SubscriptionFilter{KeyTypes: []KeyType{KeyTypeGuild}}, func(c Change) {
+		guildChanges = append(guildChanges, c)
+	})
+
+	AssertFatal(t, w.RoleCreateUpdate(nil, "1", &discordgo.Role{ID: "100"}), "failed creating role")
+	AssertFatal(t, w.EmojisUpdate(nil, "1", []*discordgo.Emoji{{ID: "300"}}), "failed updating emojis")
+	if len(roleEmojiChanges) != 2 || len(guildChanges) != 0 {
+		t.Fatalf("unexpected number of role and emoji changes: %d, %d", len(roleEmojiChanges), len(guildChanges))
+	}
+
+	if _, ok := roleEmojiChanges[0].(*RoleChange); !ok {
+		t.Errorf("unexpected role change: %#v", roleEmojiChanges[0])
+	}
+	if _, ok := roleEmojiChanges[1].(*EmojisChange); !ok {
+		t.Errorf("unexpected emojis change: %#v", roleEmojiChanges[1])
+	}
+	changes = nil
+
+	// Members
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "5"}, Roles: []string{"100"}}), "failed updating member")
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "5"}, Roles: []string{"100", "200"}}), "failed updating member")
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "2", User: &discordgo.User{ID: "5"}}), "failed updating member")
+
+	if len(changes) != 2 || len(memberChanges) != 3 {
+		t.Fatalf("unexpected number of member changes: %d, %d", len(changes), len(memberChanges))
+	}
+
+	mc, ok := changes[1].(*MemberChange)
+	if !ok || mc.Old == nil || mc.New == nil || len(mc.Old.Roles) != 1 || len(mc.New.Roles) != 2 {
+		t.Errorf("unexpected member change: %#v", changes[1])
+	}
+	changes = nil
+
+	// Messages
+	AssertFatal(t, w.MessageCreateUpdate(nil, &discordgo.Message{ID: "50", ChannelID: "10", Content: "before"}), "failed creating message")
+	AssertFatal(t, w.MessageCreateUpdate(nil, &discordgo.Message{ID: "50", ChannelID: "10", Content: "after"}), "failed updating message")
+	if len(changes) != 2 {
+		t.Fatalf("unexpected number of message changes: %d", len(changes))
+	}
+
+	msgc, ok := changes[1].(*MessageChange)
+	if !ok || msgc.GuildID != "1" || msgc.Old.Content != "before" || msgc.New.Content != "after" {
+		t.Errorf("unexpected message change: %#v", changes[1])
+	}
+	changes = nil
+
+	// Channel delete
+	AssertFatal(t, w.ChannelDelete(nil, "10"), "failed deleting channel")
+	if len(changes) != 1 {
+		t.Fatalf("unexpected number of channel changes: %d", len(changes))
+	}
+
+	cc, ok := changes[0].(*ChannelChange)
+	if !ok || cc.Old == nil || cc.Old.ID != "10" || cc.New != nil {
+		t.Errorf("unexpected channel change: %#v", changes[0])
+	}
+	changes = nil
+
+	unsub()
+	AssertFatal(t, w.GuildDelete("1"), "failed deleting guild")
+	if len(changes) != 0 {
+		t.Errorf("received changes after unsubscribing: %d", len(changes))
+	}
+}
+
+func TestHandleEventMutexSyncedResult(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:         NewMemoryStore(),
+		TrackMembers:  true,
+		TrackMessages: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	_, err = state.HandleEventMutexSyncedResult(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1", MemberCount: 1}})
+	AssertFatal(t, err, "failed handling guild create")
+	_, err = state.HandleEventMutexSyncedResult(0, &discordgo.GuildMemberAdd{Member: &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "5"}, Nick: "nick"}})
+	AssertFatal(t, err, "failed handling member add")
+	_, err = state.HandleEventMutexSyncedResult(0, &discordgo.MessageCreate{Message: &discordgo.Message{ID: "50", ChannelID: "10", Content: "original"}})
+	AssertFatal(t, err, "failed handling message create")
+
+	result, err := state.HandleEventMutexSyncedResult(0, &discordgo.MessageUpdate{Message: &discordgo.Message{ID: "50", ChannelID: "10", Content: "edited"}})
+	AssertFatal(t, err, "failed handling message update")
+	if old := result.OldMessage(); old == nil || old.Content != "original" {
+		t.Errorf("unexpected old message after update: %#v", old)
+	}
+
+	result, err = state.HandleEventMutexSyncedResult(0, &discordgo.MessageDelete{Message: &discordgo.Message{ID: "50", ChannelID: "10"}})
+	AssertFatal(t, err, "failed handling message delete")
+	if old := result.OldMessage(); old == nil || old.Content != "edited" {
+		t.Errorf("unexpected old message after delete: %#v", old)
+	}
+
+	result, err = state.HandleEventMutexSyncedResult(0, &discordgo.GuildMemberRemove{Member: &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "5"}}})
+	AssertFatal(t, err, "failed handling member remove")
+	if old := result.OldMember(); old == nil || old.Nick != "nick" {
+		t.Errorf("unexpected old member after remove: %#v", old)
+	}
+
+	// Not in state anymore
+	result, err = state.HandleEventMutexSyncedResult(0, &discordgo.MessageDelete{Message: &discordgo.Message{ID: "50", ChannelID: "10"}})
+	AssertFatal(t, err, "failed handling message delete")
+	if old := result.OldMessage(); old != nil {
+		t.Errorf("got old message for message not in state: %#v", old)
+	}
+}
+
+func TestUnsubscribeInCallback(t *testing.T) {
+	state, err := NewState(1, Options{Store: NewMemoryStore()})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	// One shot subscriber
+	calls := 0
+	var unsub func()
+	unsub = state.Subscribe(SubscriptionFilter{}, func(c Change) {
+		calls++
+		unsub()
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1"}})
+	}()
+
+	select {
+	case err = <-done:
+		AssertFatal(t, err, "failed handling guild create")
+	case <-time.After(time.Second * 5):
+		t.Fatal("deadlocked unsubscribing from inside a callback")
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "2"}}), "failed handling guild create")
+	if calls != 1 {
+		t.Errorf("one shot subscriber called %d times", calls)
+	}
+}
@@ -31,6 +31,12 @@ type Item struct {
 	DestType        string
 	IteratorOptions string
 	Seek            string
+
+	// If set, also generates a function with this name that counts the keys without retrieving the values
+	CountName string
+
+	// If set, this expression is evaluated with the decoded dest before passing it to the callback, it returns an error
+	Fill string
 }
 
 type Arg struct {
@@ -40,20 +46,24 @@ type Arg struct {
 
 var Iterators = []Item{
 	Item{
-		Name:     "IterateGuilds",
-		Key:      "[]byte{byte(KeyTypeGuild)}",
-		DestType: "*discordgo.Guild",
+		Name:      "IterateGuilds",
+		Key:       "[]byte{byte(KeyTypeGuild)}",
+		DestType:  "*discordgo.Guild",
+		CountName: "CountGuilds",
+		Fill:      "s.fillGuild(txn, dest)",
 	},
 	Item{
-		Name:     "IteratePresences",
-		Key:      "[]byte{byte(KeyTypePresence)}",
-		DestType: "*discordgo.Presence",
+		Name:      "IteratePresences",
+		Key:       "[]byte{byte(KeyTypePresence)}",
+		DestType:  "*discordgo.Presence",
+		CountName: "CountPresences",
 	},
 	Item{
 		Name:      "IterateGuildMembers",
 		ExtraArgs: []Arg{{Name: "guildID", Type: "string"}},
 		Key:       "KeyGuildMembersIteratorPrefix(guildID)",
 		DestType:  "*discordgo.Member",
+		CountName: "CountGuildMembers",
 	},
 	Item{
 		Name:      "IterateChannelMessages",
@@ -61,6 +71,7 @@ var Iterators = []Item{
 		Key:       "KeyChannelMessageIteratorPrefix(channelID)",
 		DestType:  "*discordgo.Message",
 		CBMeta:    "MessageFlag",
+		CountName: "CountChannelMessages",
 	},
 	Item{
 		Name:      "IterateChannelMessagesNewerFirst",
@@ -96,54 +107,119 @@ var Iterators = []Item{
 		Key:       "KeyVoiceStateIteratorPrefix(guildID)",
 		DestType:  "*discordgo.VoiceState",
 	},
+	Item{
+		Name:      "IterateGuildRoles",
+		ExtraArgs: []Arg{{Name: "guildID", Type: "string"}},
+		Key:       "KeyGuildRolesIteratorPrefix(guildID)",
+		DestType:  "*discordgo.Role",
+	},
+	Item{
+		Name:      "IterateGuildEmojis",
+		ExtraArgs: []Arg{{Name: "guildID", Type: "string"}},
+		Key:       "KeyGuildEmojisIteratorPrefix(guildID)",
+		DestType:  "*discordgo.Emoji",
+	},
 }
 
 const (
 	RawTemplate = `package dbstate
 
 import (
+	"bytes"
 	"github.com/bwmarrin/discordgo"
-	"github.com/dgraph-io/badger"
 )
 {{range .}}
 // {{.Name}} Iterates over all {{.DestType}} in state, calling f on them
 // if f returns false then iteration will stop
-func (s *State) {{.Name}}(txn *badger.Txn, {{range .ExtraArgs}}{{.Name}} {{.Type}}, {{end}}f func({{if .CBMeta}}m {{.CBMeta}}, {{end}}d {{.DestType}}) bool) error {
+func (s *State) {{.Name}}(txn Txn, {{range .ExtraArgs}}{{.Name}} {{.Type}}, {{end}}f func({{if .CBMeta}}m {{.CBMeta}}, {{end}}d {{.DestType}}) bool) error {
+	_, err := s.{{.Name}}Page(txn, {{range .ExtraArgs}}{{.Name}}, {{end}}nil, 0, f)
+	return err
+}
+
+// {{.Name}}Page is the same as {{.Name}} but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) {{.Name}}Page(txn Txn, {{range .ExtraArgs}}{{.Name}} {{.Type}}, {{end}}cursor Cursor, limit int, f func({{if .CBMeta}}m {{.CBMeta}}, {{end}}d {{.DestType}}) bool) (next Cursor, err error) {
 	if txn == nil {
-		return s.DB.View(func(txn *badger.Txn) error {
-			return s.{{.Name}}(txn, {{range .ExtraArgs}}{{.Name}}, {{end}}f)
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.{{.Name}}Page(txn, {{range .ExtraArgs}}{{.Name}}, {{end}}cursor, limit, f)
+			return err
 		})
+		return
 	}
 
 	// Scan over the prefix
 	prefix := {{.Key}}
 	seek := prefix{{.Seek}}
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
 
-	opts := badger.DefaultIteratorOptions{{.IteratorOptions}}
+	opts := DefaultIteratorOptions{{.IteratorOptions}}
 	it := txn.NewIterator(opts)
-	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		v, err := item.Value()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var dest {{.DestType}}
 		err = s.DecodeData(v, &dest)
 		if err != nil {
-			return err
-		}{{if .CBMeta}}
+			return nil, err
+		}{{if .Fill}}
+
+		err = {{.Fill}}
+		if err != nil {
+			return nil, err
+		}{{end}}{{if .CBMeta}}
 
 		meta := {{.CBMeta}}(item.UserMeta()){{end}}
+		n++
 
 		// Call the callback
-		if !f({{if .CBMeta}}meta, {{end}}dest) {
+		if !f({{if .CBMeta}}meta, {{end}}dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
 			break
 		}
 	}
-	return nil
+	return next, nil
+}
+{{if .CountName}}
+// {{.CountName}} returns the number of {{.DestType}} {{.Name}} would iterate over, without retrieving or decoding the values
+func (s *State) {{.CountName}}({{range $i, $e := .ExtraArgs}}{{if $i}}, {{end}}{{.Name}} {{.Type}}{{end}}) (int, error) {
+	return s.{{.CountName}}WithTxn(nil{{range .ExtraArgs}}, {{.Name}}{{end}})
+}
+
+// {{.CountName}}WithTxn is the same as {{.CountName}} but allows you to pass a transaction
+func (s *State) {{.CountName}}WithTxn(txn Txn{{range .ExtraArgs}}, {{.Name}} {{.Type}}{{end}}) (n int, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			n, err = s.{{.CountName}}WithTxn(txn{{range .ExtraArgs}}, {{.Name}}{{end}})
+			return err
+		})
+		return
+	}
+
+	return countKeysWithPrefix(txn, {{.Key}}), nil
 }
-{{end}}
+{{end}}{{end}}
 `
 )
 
@@ -0,0 +1,43 @@
+package dbstate
+
+import (
+	"github.com/json-iterator/go"
+	"io"
+)
+
+// Codec is used to encode and decode all the values stored in state
+//
+// The name of the codec is stored in the database meta, opening a database with another codec
+// than the one it was created with will fail with ErrDifferentCodec
+type Codec interface {
+	// Name returns the unique name of the codec, this is what's stored in MetaInfo
+	Name() string
+
+	// NewEncoder returns a new encoder writing to w, each shard keeps their own encoder around and reuses it
+	NewEncoder(w io.Writer) Encoder
+
+	// Decode decodes data into dest, dest is always a pointer
+	Decode(data []byte, dest interface{}) error
+}
+
+// Encoder encodes values into the writer it was created with
+type Encoder interface {
+	Encode(val interface{}) error
+}
+
+// JSONCodec is the default codec, it encodes values as json using jsoniter
+type JSONCodec struct{}
+
+var _ Codec = (*JSONCodec)(nil)
+
+func (c *JSONCodec) Name() string {
+	return "json"
+}
+
+func (c *JSONCodec) NewEncoder(w io.Writer) Encoder {
+	return jsoniter.NewEncoder(w)
+}
+
+func (c *JSONCodec) Decode(data []byte, dest interface{}) error {
+	return jsoniter.Unmarshal(data, dest)
+}
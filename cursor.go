@@ -0,0 +1,41 @@
+package dbstate
+
+import (
+	"encoding/base64"
+	"github.com/pkg/errors"
+)
+
+var (
+	// Returned by the paginated iterators when the cursor does not belong to the iteration (e.g a cursor from IterateGuildsPage passed to IteratePresencesPage)
+	ErrInvalidCursor = errors.New("Invalid cursor")
+)
+
+// Cursor is an opaque position in an iteration, returned by the paginated iterators (e.g IterateGuildMembersPage)
+// and passed back to them to continue where the previous page ended, a nil cursor starts from the beginning
+type Cursor []byte
+
+func newCursor(key []byte) Cursor {
+	c := make(Cursor, len(key))
+	copy(c, key)
+	return c
+}
+
+// String returns the cursor encoded as a url safe string, e.g for passing it to the client of an api
+// use ParseCursor to decode it
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(c)
+}
+
+// ParseCursor decodes a cursor encoded with Cursor.String, an empty string returns a nil cursor
+func ParseCursor(s string) (Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	c, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return Cursor(c), nil
+}
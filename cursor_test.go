@@ -0,0 +1,80 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"testing"
+)
+
+func TestIteratorPagination(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store: NewMemoryStore(),
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	for i := 1; i <= 25; i++ {
+		AssertFatal(t, state.shards[0].MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: strconv.Itoa(i)}}), "failed adding member")
+		AssertFatal(t, state.shards[0].MessageCreateUpdate(nil, &discordgo.Message{ChannelID: "2", ID: strconv.Itoa(i)}), "failed adding message")
+	}
+
+	var ids []string
+	var cursor Cursor
+	pages := 0
+	for {
+		cursor, err = state.IterateGuildMembersPage(nil, "1", cursor, 10, func(m *discordgo.Member) bool {
+			ids = append(ids, m.User.ID)
+			return true
+		})
+		AssertFatal(t, err, "failed iterating members")
+		pages++
+
+		if cursor == nil {
+			break
+		}
+
+		// Pass it through the string form like an api would
+		cursor, err = ParseCursor(cursor.String())
+		AssertFatal(t, err, "failed parsing cursor")
+	}
+
+	if pages != 3 || len(ids) != 25 {
+		t.Fatalf("unexpected pagination result: %d pages, %d members", pages, len(ids))
+	}
+
+	for i, v := range ids {
+		if v != strconv.Itoa(i+1) {
+			t.Errorf("unexpected member %d: %s", i, v)
+		}
+	}
+
+	// Reverse iteration, stopped by the callback
+	var messageIDs []string
+	cursor, err = state.IterateChannelMessagesNewerFirstPage(nil, "2", nil, 0, func(m MessageFlag, msg *discordgo.Message) bool {
+		messageIDs = append(messageIDs, msg.ID)
+		return len(messageIDs) < 5
+	})
+	AssertFatal(t, err, "failed iterating messages")
+
+	_, err = state.IterateChannelMessagesNewerFirstPage(nil, "2", cursor, 2, func(m MessageFlag, msg *discordgo.Message) bool {
+		messageIDs = append(messageIDs, msg.ID)
+		return true
+	})
+	AssertFatal(t, err, "failed iterating messages")
+
+	expected := []string{"25", "24", "23", "22", "21", "20", "19"}
+	if len(messageIDs) != len(expected) {
+		t.Fatalf("unexpected messages: %v", messageIDs)
+	}
+	for i, v := range messageIDs {
+		if v != expected[i] {
+			t.Errorf("unexpected message %d: %s, expected %s", i, v, expected[i])
+		}
+	}
+
+	// Cursor from a different iteration
+	_, err = state.IteratePresencesPage(nil, cursor, 0, func(p *discordgo.Presence) bool { return true })
+	if err != ErrInvalidCursor {
+		t.Error("expected ErrInvalidCursor, got: ", err)
+	}
+}
@@ -1,4 +1,4 @@
-// Package dbstate is a package that provides a discord state tracker using badger as the underlying store
+// Package dbstate is a package that provides a discord state tracker using badger (or any other Store) as the underlying store
 // allowing for the state to grow beyond the avilable system memory
 package dbstate
 
@@ -24,13 +24,20 @@ const (
 	VersionMinor = 2
 	VersionPatch = 0
 
-	// The database format version, different versions are incompatible with eachother
+	// The database format version, older versions are migrated on start if there's a migration registered for them (see migrations.go)
 	// Changes over the versions:
 	// pre-v2: were string based keys
 	// v2: introduced compact binary keys
 	// v3: changed the format itself to json
 	// v4: changed the endiannes of keys to big endian, so they're sorted properly
-	FormatVersion = 4
+	// v5: added the member name index
+	// v6: added the role member index
+	// v7: added the voice channel index
+	// v8: added the message author index
+	// v9: moved the roles, emojis and channel list of guilds to their own keys
+	// v10: added the DM channel indexes
+	// v11: added all guild channel types to the channels of the guild
+	FormatVersion = 11
 )
 
 var (
@@ -38,16 +45,23 @@ var (
 )
 
 var (
-	// Used when the loaded db version differs from the one used in this package version
+	// Used when the loaded db version differs from the one used in this package version, and it can't be migrated
 	ErrDifferentFormatVersion = errors.New("Trying to open database with different format version than the current one.")
 
-	// Used in some places, but badger.ErrKeyNotFound may also be returned some places
+	// Used when the loaded db was created with a different codec than the one in Options.Codec
+	ErrDifferentCodec = errors.New("Trying to open database with a different codec than the one it was created with.")
+
+	// Returned when something is not found in state, the stores return this aswell when a key does not exist
 	// use the IsNotFound(err) function to determine if an error was the result of somehting not being found in state
 	ErrNotFound = errors.New("Object not found in state")
+
+	// Returned by the HandleEvent functions after State.Close has been called
+	ErrStateClosed = errors.New("State has been closed")
 )
 
 type State struct {
-	DB *badger.DB
+	// The underlying key value store, a BadgerStore unless Options.Store was set
+	Store Store
 
 	opts *Options
 
@@ -62,6 +76,15 @@ type State struct {
 	presenceUpdateFilter *presenceUpdateFilter
 
 	stopChan chan interface{}
+
+	// Used to wait for the workers to finish handling the queued up events on close
+	workersWG sync.WaitGroup
+
+	// Wether the previous run closed the state cleanly, see PreviousShutdownClean
+	previousShutdownClean bool
+
+	// Listeners for changes to the state, see Subscribe
+	subscriptions subscriptions
 }
 
 type Logger interface {
@@ -76,7 +99,7 @@ type shardWorker struct {
 	shardID      int
 	buffer       *bytes.Buffer
 	decodeBuffer []byte
-	encoder      *jsoniter.Encoder
+	encoder      Encoder
 	working      bool
 
 	// Used for the channel sync mode
@@ -84,6 +107,18 @@ type shardWorker struct {
 
 	// Used for the mutex sync mode
 	MU *sync.Mutex
+
+	// The current gateway session, sequence is accessed atomically
+	sessionMU sync.Mutex
+	sessionID string
+	sequence  int64
+
+	// Changes made in the current transaction, dispatched to the subscribers once it's committed
+	pendingChanges []Change
+
+	// Set while handling an event with HandleEventMutexSyncedResult, the committed changes are collected in capturedChanges
+	captureChanges  bool
+	capturedChanges []Change
 }
 
 // Small in memory state that holds a small amount of information
@@ -97,8 +132,13 @@ type Options struct {
 	// Badger db options
 	// If nil, then it will use the default badger db options
 	// with path to /tmp/
+	// Not used if Store is set
 	DBOpts *badger.Options
 
+	// Store to use instead of badger, e.g a BoltStore
+	// Unlike with badger, the data in it is flushed (see KeepOldMessagesOnStart) using individual deletes on start instead of wiping the folder
+	Store Store
+
 	// channelSyncMode: if this is set it will also spin up the event channel receivers per shard
 	// set this is you're gonna use the channel sync mode (see State.HandleEvent*)
 	UseChannelSyncMode bool
@@ -115,12 +155,37 @@ type Options struct {
 	// Set to keep old messages in state from previous runs
 	KeepOldMessagesOnStart bool
 
+	// Set to keep the whole state (guilds, members, channels and so on) from the previous run
+	// if it was closed cleanly using State.Close, together with the shard sessions (see State.ShardSession) this allows the shards to RESUME
+	// If the previous shutdown was not clean the state is flushed like normal
+	//
+	// The sequence number of the session is taken from the raw *discordgo.Event, which has to be passed to the state after its typed event,
+	// so discordgo.Session.SyncEvents has to be set, otherwise the handlers run in their own goroutines and the sequence number
+	// can get ahead of the state, making a RESUME skip events that were never handled
+	KeepStateOnStart bool
+
 	// Set to keep deleted messages in state, they will stil expire after MessageTTL
 	// The deleted return value of ChannelMessage will be set
 	KeepDeletedMessages bool
 
+	// Set to also track which users reacted to messages and not just the reaction counts, see MessageReactionUsers
+	// Requires TrackMessages, the entries expire with the message
+	TrackReactionUsers bool
+
 	// Custom logger to use, the state itself implements this so it defaults to state if nil
 	Logger Logger
+
+	// Number of keys migrated per transaction when migrating the database from an older format version
+	// Defaults to DefaultMigrationBatchSize
+	MigrationBatchSize int
+
+	// If set, migrations will only log what they would change without writing anything
+	// and NewState will return ErrMigrationDryRun if there were any migrations to run
+	DryRunMigrations bool
+
+	// Codec used to encode and decode the values in state, defaults to JSONCodec if nil
+	// The codec name is stored in the database, so a database has to be opened with the same codec it was created with
+	Codec Codec
 }
 
 // ReommendedBadgerOptions returns the recommended options for badger
@@ -150,19 +215,21 @@ func RecommendedBadgerOptions(dir string) *badger.Options {
 
 // NewState creates a new state tracker, or an error if something went wrong
 func NewState(numShards int, options Options) (*State, error) {
-	if options.DBOpts == nil {
-		options.DBOpts = RecommendedBadgerOptions("")
-	}
-
-	err := initFolder(options.DBOpts.Dir, !options.KeepOldMessagesOnStart)
+	store := options.Store
+	if store == nil {
+		if options.DBOpts == nil {
+			options.DBOpts = RecommendedBadgerOptions("")
+		}
 
-	if err != nil {
-		return nil, errors.WithMessage(err, "InitFolder")
-	}
+		err := initFolder(options.DBOpts.Dir, !options.KeepOldMessagesOnStart && !options.KeepStateOnStart)
+		if err != nil {
+			return nil, errors.WithMessage(err, "InitFolder")
+		}
 
-	db, err := badger.Open(*options.DBOpts)
-	if err != nil {
-		return nil, errors.WithMessage(err, "BadgerOpen")
+		store, err = OpenBadgerStore(options.DBOpts)
+		if err != nil {
+			return nil, errors.WithMessage(err, "BadgerOpen")
+		}
 	}
 
 	if numShards < 1 {
@@ -172,12 +239,12 @@ func NewState(numShards int, options Options) (*State, error) {
 	shards := make([]*shardWorker, numShards)
 
 	s := &State{
-		DB:                   db,
+		Store:                store,
 		opts:                 &options,
 		numShards:            numShards,
 		shards:               shards,
 		memoryState:          &memoryState{},
-		presenceUpdateFilter: &presenceUpdateFilter{numShards: numShards},
+		presenceUpdateFilter: newPresenceUpdateFilter(numShards),
 		stopChan:             make(chan interface{}),
 	}
 
@@ -185,20 +252,52 @@ func NewState(numShards int, options Options) (*State, error) {
 		options.Logger = s
 	}
 
-	err = s.initDB()
+	if options.Codec == nil {
+		options.Codec = &JSONCodec{}
+	}
+
+	// The workers need to be created before initDB as it may load the shard sessions into them
+	s.initWorkers(shards)
+
+	err := s.initDB()
 	if err != nil {
+		store.Close()
 		return nil, errors.WithMessage(err, "initDB")
 	}
 
 	go s.gcWorker()
-	s.initWorkers(shards, options.UseChannelSyncMode)
+	if options.UseChannelSyncMode {
+		s.runWorkers()
+	}
 	return s, nil
 }
 
 // Close shuts the tracker down, closing the DB aswell
+//
+// It waits for the workers to handle the events still queued up, then saves the shard sessions
+// and marks the shutdown as clean so the state can be kept on the next start (see Options.KeepStateOnStart)
+// Events passed to the state after this return ErrStateClosed
 func (s *State) Close() {
 	close(s.stopChan)
-	s.DB.Close()
+	s.workersWG.Wait()
+
+	// Wait for the mutex synced events being handled
+	for _, w := range s.shards {
+		w.MU.Lock()
+		w.MU.Unlock()
+	}
+
+	err := s.saveShardSessions()
+	if err != nil {
+		s.opts.Logger.LogError("Failed saving shard sessions: ", err)
+	} else {
+		err = s.markCleanShutdown()
+		if err != nil {
+			s.opts.Logger.LogError("Failed marking clean shutdown: ", err)
+		}
+	}
+
+	s.Store.Close()
 }
 
 func (s *State) gcWorker() {
@@ -213,64 +312,189 @@ func (s *State) gcWorker() {
 		case <-t1s.C:
 			s.presenceUpdateFilter.clear()
 		case <-t1m.C:
-			s.opts.Logger.LogInfo("Starting badger gc...")
-
-			// Enabling this made all the keys suddenly stop working, I think I may be doing something wrong in this regard.
-			// db.PurgeOlderVersions()
-
-			s.DB.RunValueLogGC(0.5)
-			s.opts.Logger.LogInfo("Done with badger gc.")
+			s.opts.Logger.LogInfo("Starting store gc...")
+			s.Store.RunGC()
+			s.opts.Logger.LogInfo("Done with store gc.")
 		}
 	}
 }
 
-func (s *State) initWorkers(workers []*shardWorker, run bool) {
+func (s *State) initWorkers(workers []*shardWorker) {
 	for i, _ := range workers {
 		workers[i] = &shardWorker{
 			State:     s,
 			shardID:   i,
 			buffer:    new(bytes.Buffer),
 			eventChan: make(chan interface{}, 10),
+			MU:        new(sync.Mutex),
 		}
 
-		workers[i].encoder = jsoniter.NewEncoder(workers[i].buffer)
+		workers[i].encoder = s.opts.Codec.NewEncoder(workers[i].buffer)
+	}
+}
 
-		if run {
-			go workers[i].run()
-		}
+func (s *State) runWorkers() {
+	for _, w := range s.shards {
+		s.workersWG.Add(1)
+		go w.run()
 	}
 }
 
+// MetaInfo is stored under KeyMeta and describes the format of the database
+// It's always encoded as json regardless of the codec, so that a codec mismatch can be detected
 type MetaInfo struct {
 	FormatVersion int
+
+	// Name of the codec the values are encoded with, databases created before this was added are json
+	Codec string
+
+	// Set to the version being migrated from while a migration is running
+	MigratingFrom int `json:",omitempty"`
+
+	// Set when the state is closed, and unset again on start
+	// If this is not set on start, the state was not closed properly and may be inconsistent
+	CleanShutdown bool
 }
 
 func (s *State) initDB() error {
-	var meta *MetaInfo
-	_, err := s.GetKey(nil, KeyMeta, &meta)
+	meta, err := s.getMeta(nil)
 	if err != nil {
-		if err == badger.ErrKeyNotFound {
+		if err == ErrNotFound {
 			meta = &MetaInfo{
 				FormatVersion: FormatVersion,
+				Codec:         s.opts.Codec.Name(),
 			}
-			return s.SetKey(nil, nil, nil, KeyMeta, meta)
+			return s.setMeta(nil, meta)
 		}
 
 		return err
 	}
 
-	if meta.FormatVersion != FormatVersion {
-		return ErrDifferentFormatVersion
+	if meta.Codec == "" {
+		meta.Codec = (&JSONCodec{}).Name()
+	}
+
+	if meta.Codec != s.opts.Codec.Name() {
+		return errors.WithMessage(ErrDifferentCodec, fmt.Sprintf("db: %q, options: %q", meta.Codec, s.opts.Codec.Name()))
+	}
+
+	s.previousShutdownClean = meta.CleanShutdown
+	keepState := s.opts.KeepStateOnStart && meta.CleanShutdown
+	if s.opts.KeepStateOnStart && !keepState {
+		s.opts.Logger.LogWarn("Previous shutdown was not clean, not keeping the state from the previous run")
 	}
 
-	if s.opts.KeepOldMessagesOnStart {
+	// Check that the database can be migrated before flushing anything from it
+	err = checkMigratable(meta)
+	if err != nil {
+		return err
+	}
+
+	// The data is left as is in dry run mode
+	if !keepState && !s.opts.DryRunMigrations && (s.opts.KeepOldMessagesOnStart || s.opts.KeepStateOnStart || s.opts.Store != nil) {
+		// Flush before migrating so there's less to migrate
 		err = s.flushOldDBData()
-		return errors.WithMessage(err, "flushOldDBData")
+		if err != nil {
+			return errors.WithMessage(err, "flushOldDBData")
+		}
+	}
+
+	if meta.FormatVersion != FormatVersion || meta.MigratingFrom != 0 {
+		err = s.migrate(meta)
+		if err != nil {
+			return errors.WithMessage(err, "migrate")
+		}
 	}
 
+	if keepState {
+		err = s.loadKeptState()
+		if err != nil {
+			return errors.WithMessage(err, "loadKeptState")
+		}
+	}
+
+	// Unset until we're closed again
+	meta.CleanShutdown = false
+	return s.setMeta(nil, meta)
+}
+
+// loadKeptState loads the in memory parts of the state kept from the previous run
+func (s *State) loadKeptState() error {
+	err := s.loadShardSessions()
+	if err != nil {
+		return err
+	}
+
+	var user *discordgo.User
+	_, err = s.GetKey(nil, KeySelfUser, &user)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	s.memoryState.Lock()
+	s.memoryState.User = user
+	s.memoryState.Unlock()
 	return nil
 }
 
+// markCleanShutdown sets MetaInfo.CleanShutdown, this should be the last thing written
+func (s *State) markCleanShutdown() error {
+	return s.RetryUpdate(func(txn Txn) error {
+		meta, err := s.getMeta(txn)
+		if err != nil {
+			return err
+		}
+
+		meta.CleanShutdown = true
+		return s.setMeta(txn, meta)
+	})
+}
+
+// getMeta retrieves the MetaInfo, bypassing the codec
+// If tx is nil, will create a new transaction
+func (s *State) getMeta(txn Txn) (meta *MetaInfo, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			meta, err = s.getMeta(txn)
+			return err
+		})
+		return
+	}
+
+	item, err := txn.Get(KeyMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	err = jsoniter.Unmarshal(v, &meta)
+	return
+}
+
+// setMeta stores the MetaInfo, bypassing the codec
+// If tx is nil, will create a new transaction
+func (s *State) setMeta(txn Txn, meta *MetaInfo) error {
+	if txn == nil {
+		return s.RetryUpdate(func(txn Txn) error {
+			return s.setMeta(txn, meta)
+		})
+	}
+
+	encoded, err := jsoniter.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(KeyMeta, encoded)
+}
+
 func (s *State) flushOldDBData() error {
 
 	s.opts.Logger.LogInfo("Flushing old DB data...")
@@ -282,9 +506,9 @@ func (s *State) flushOldDBData() error {
 	for !done {
 		curKey := []byte{}
 
-		err := s.DB.Update(func(txn *badger.Txn) error {
+		err := s.Store.Update(func(txn Txn) error {
 
-			opts := badger.DefaultIteratorOptions
+			opts := DefaultIteratorOptions
 			opts.PrefetchValues = false
 			it := txn.NewIterator(opts)
 
@@ -297,7 +521,7 @@ func (s *State) flushOldDBData() error {
 
 			i := 0
 			for ; it.Valid(); it.Next() {
-				if s.opts.KeepOldMessagesOnStart && it.ValidForPrefix([]byte{byte(KeyTypeChannelMessage)}) {
+				if s.opts.KeepOldMessagesOnStart && isMessageKeyType(KeyType(it.Item().Key()[0])) {
 					// Keep old messages
 					continue
 				}
@@ -3,8 +3,11 @@ package dbstate
 import (
 	"bytes"
 	"fmt"
-	"github.com/dgraph-io/badger"
 	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
 	// "github.com/alecthomas/binary"
 	"github.com/bwmarrin/discordgo"
 	"testing"
@@ -23,10 +26,8 @@ func init() {
 }
 
 func SetupTestState() *State {
-
-	badgerOpts := RecommendedBadgerOptions("")
 	opts := Options{
-		DBOpts: badgerOpts,
+		Store: NewMemoryStore(),
 	}
 
 	state, err := NewState(1, opts)
@@ -62,6 +63,37 @@ func TestEncodeDecode(t *testing.T) {
 	}
 }
 
+type renamedCodec struct {
+	JSONCodec
+	name string
+}
+
+func (c *renamedCodec) Name() string {
+	return c.name
+}
+
+func (c *renamedCodec) NewEncoder(w io.Writer) Encoder {
+	return jsoniter.NewEncoder(w)
+}
+
+func TestCodecMismatch(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_codec")
+	defer os.RemoveAll(dir)
+
+	state, err := NewState(1, Options{DBOpts: RecommendedBadgerOptions(dir)})
+	AssertFatal(t, err, "failed creating state")
+	state.Close()
+
+	_, err = NewState(1, Options{DBOpts: RecommendedBadgerOptions(dir), KeepOldMessagesOnStart: true, Codec: &renamedCodec{name: "other"}})
+	if errors.Cause(err) != ErrDifferentCodec {
+		t.Fatal("expected ErrDifferentCodec, got: ", err)
+	}
+
+	state, err = NewState(1, Options{DBOpts: RecommendedBadgerOptions(dir), KeepOldMessagesOnStart: true, Codec: &renamedCodec{name: "json"}})
+	AssertFatal(t, err, "failed reopening state with the same codec")
+	state.Close()
+}
+
 func AssertFatal(t *testing.T, err error, msg ...interface{}) {
 	if err != nil {
 		t.Fatal(fmt.Sprint(msg...) + ": " + err.Error())
@@ -85,7 +117,7 @@ func BenchmarkEncode(b *testing.B) {
 	}
 
 	for i := 0; i < b.N; i++ {
-		_, err := (*State)(nil).encodeData(nil, nil, testStruct)
+		_, err := testState.encodeData(nil, nil, testStruct)
 		if err != nil {
 			panic(err)
 		}
@@ -107,7 +139,7 @@ func BenchmarkEncodeReuseBufEnc(b *testing.B) {
 
 	for i := 0; i < b.N; i++ {
 
-		_, err := (*State)(nil).encodeData(&buf, encoder, testStruct)
+		_, err := testState.encodeData(&buf, encoder, testStruct)
 		if err != nil {
 			panic(err)
 		}
@@ -117,9 +149,9 @@ func BenchmarkEncodeReuseBufEnc(b *testing.B) {
 }
 
 func DeleteAllWithPrefix(prefix []byte) {
-	testState.DB.Update(func(txn *badger.Txn) error {
+	testState.Store.Update(func(txn Txn) error {
 		// Scan over the prefix
-		opts := badger.DefaultIteratorOptions
+		opts := DefaultIteratorOptions
 		it := txn.NewIterator(opts)
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
@@ -0,0 +1,141 @@
+package dbstate
+
+import (
+	"encoding/binary"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+)
+
+// Private channels (DM's and group DM's) are stored as all other channels, with a index of them and
+// a index of the DM channel by recipient
+
+// UserDMChannel returns the DM channel with a user, ErrNotFound if it's not in state
+func (s *State) UserDMChannel(userID string) (*discordgo.Channel, error) {
+	return s.UserDMChannelWithTxn(nil, userID)
+}
+
+// UserDMChannelWithTxn is the same as UserDMChannel but allows you to pass a transaction
+func (s *State) UserDMChannelWithTxn(txn Txn, userID string) (st *discordgo.Channel, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			st, err = s.UserDMChannelWithTxn(txn, userID)
+			return err
+		})
+		return
+	}
+
+	channelID, err := userDMChannelID(txn, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ChannelWithTxn(txn, channelID)
+}
+
+// IterateDMChannels iterates over all the DM and group DM channels in state, calling f on them
+// if f returns false then iteration will stop
+func (s *State) IterateDMChannels(txn Txn, f func(c *discordgo.Channel) bool) error {
+	if txn == nil {
+		return s.Store.View(func(txn Txn) error {
+			return s.IterateDMChannels(txn, f)
+		})
+	}
+
+	prefix := []byte{byte(KeyTypeDMChannel)}
+
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		channelID := strconv.FormatUint(binary.BigEndian.Uint64(it.Item().Key()[1:]), 10)
+
+		c, err := s.ChannelWithTxn(txn, channelID)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return err
+		}
+
+		if !f(c) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func isPrivateChannel(c *discordgo.Channel) bool {
+	return c.Type == discordgo.ChannelTypeDM || c.Type == discordgo.ChannelTypeGroupDM
+}
+
+// userDMChannelID returns the id of the DM channel with userID from the recipient index
+func userDMChannelID(txn Txn, userID string) (string, error) {
+	item, err := txn.Get(KeyUserDMChannel(userID))
+	if err != nil {
+		return "", err
+	}
+
+	v, err := item.Value()
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatUint(binary.BigEndian.Uint64(v), 10), nil
+}
+
+// setDMChannelIndexes adds a private channel to the DM channel indexes
+func (w *shardWorker) setDMChannelIndexes(txn Txn, c *discordgo.Channel) error {
+	err := txn.Set(KeyDMChannel(c.ID), []byte{})
+	if err != nil {
+		return err
+	}
+
+	// Only DM's are indexed by recipient, a user can be in any number of group DM's
+	if c.Type != discordgo.ChannelTypeDM {
+		return nil
+	}
+
+	for _, v := range c.Recipients {
+		if w.isSelfUser(v.ID) {
+			continue
+		}
+
+		err = txn.Set(KeyUserDMChannel(v.ID), idValue(c.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteDMChannelIndexes removes a private channel from the DM channel indexes
+func (w *shardWorker) deleteDMChannelIndexes(txn Txn, c *discordgo.Channel) error {
+	err := txn.Delete(KeyDMChannel(c.ID))
+	if err != nil {
+		return err
+	}
+
+	for _, v := range c.Recipients {
+		// A newer DM channel with the user could have replaced it
+		current, err := userDMChannelID(txn, v.ID)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return err
+		}
+
+		if current != c.ID {
+			continue
+		}
+
+		err = txn.Delete(KeyUserDMChannel(v.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDMChannels(t *testing.T) {
+	state, err := NewState(1, Options{Store: NewMemoryStore(), TrackChannels: true})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	events := []interface{}{
+		&discordgo.Ready{
+			User:            &discordgo.User{ID: "1"},
+			PrivateChannels: []*discordgo.Channel{{ID: "10", Type: discordgo.ChannelTypeDM, Recipients: []*discordgo.User{{ID: "5"}}}},
+		},
+		&discordgo.ChannelCreate{Channel: &discordgo.Channel{ID: "11", Type: discordgo.ChannelTypeDM, Recipients: []*discordgo.User{{ID: "6"}}}},
+		&discordgo.ChannelCreate{Channel: &discordgo.Channel{ID: "12", Type: discordgo.ChannelTypeGroupDM, Recipients: []*discordgo.User{{ID: "5"}, {ID: "6"}}}},
+	}
+
+	for _, v := range events {
+		AssertFatal(t, state.HandleEventNoSync(0, v), "failed handling event")
+	}
+
+	c, err := state.UserDMChannel("5")
+	AssertFatal(t, err, "failed retrieving dm channel")
+	if c.ID != "10" {
+		t.Errorf("unexpected dm channel: %s", c.ID)
+	}
+
+	var ids []string
+	err = state.IterateDMChannels(nil, func(c *discordgo.Channel) bool {
+		ids = append(ids, c.ID)
+		return true
+	})
+	AssertFatal(t, err, "failed iterating dm channels")
+	if len(ids) != 3 || ids[0] != "10" || ids[1] != "11" || ids[2] != "12" {
+		t.Errorf("unexpected dm channels: %v", ids)
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.ChannelDelete{Channel: &discordgo.Channel{ID: "11"}}), "failed handling channel delete")
+	if _, err = state.UserDMChannel("6"); err != ErrNotFound {
+		t.Error("deleted dm channel still indexed: ", err)
+	}
+
+	// Deleting the group DM should not remove the DM's of its recipients
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.ChannelDelete{Channel: &discordgo.Channel{ID: "12"}}), "failed handling channel delete")
+	if _, err = state.UserDMChannel("5"); err != nil {
+		t.Error("dm channel removed with a group dm: ", err)
+	}
+}
+
+func TestMigrateV9DMChannelIndex(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_migrate_v9")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	opts := Options{DBOpts: RecommendedBadgerOptions(dir), KeepStateOnStart: true, TrackChannels: true}
+	state, err := NewState(1, opts)
+	AssertFatal(t, err, "failed creating state")
+
+	// The self user should not be indexed, same as when the channel is created at runtime
+	err = state.SetKey(nil, nil, nil, KeySelfUser, &discordgo.User{ID: "1"})
+	AssertFatal(t, err, "failed setting self user")
+	err = state.SetKey(nil, nil, nil, KeyChannel("10"), &discordgo.Channel{ID: "10", Type: discordgo.ChannelTypeDM, Recipients: []*discordgo.User{{ID: "1"}, {ID: "5"}}})
+	AssertFatal(t, err, "failed setting channel")
+
+	meta, err := state.getMeta(nil)
+	AssertFatal(t, err, "failed retrieving meta")
+	meta.FormatVersion = 9
+	AssertFatal(t, state.setMeta(nil, meta), "failed setting meta")
+	state.Close()
+
+	state, err = NewState(1, opts)
+	AssertFatal(t, err, "failed migrating")
+	defer state.Close()
+
+	c, err := state.UserDMChannel("5")
+	AssertFatal(t, err, "failed retrieving dm channel")
+	if c.ID != "10" {
+		t.Errorf("unexpected dm channel: %s", c.ID)
+	}
+
+	if _, err = state.UserDMChannel("1"); err != ErrNotFound {
+		t.Error("self user indexed by the migration: ", err)
+	}
+}
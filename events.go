@@ -3,7 +3,6 @@ package dbstate
 import (
 	"fmt"
 	"github.com/bwmarrin/discordgo"
-	"github.com/dgraph-io/badger"
 	"github.com/pkg/errors"
 	"reflect"
 	"time"
@@ -14,13 +13,17 @@ import (
 // Use this as opposed to HandleEventMutexSynced if you're okay with
 // this function returning before the state has actually been updated from the event
 func (s *State) HandleEventChannelSynced(shardID int, eventInterface interface{}) error {
-	if !s.handleEventPreCheck(shardID, eventInterface) {
-		return nil
+	if handle, err := s.handleEventPreCheck(shardID, eventInterface); !handle {
+		return err
 	}
 
 	// Send the event to the proper worker
-	s.shards[shardID].eventChan <- eventInterface
-	return nil
+	select {
+	case s.shards[shardID].eventChan <- eventInterface:
+		return nil
+	case <-s.stopChan:
+		return ErrStateClosed
+	}
 }
 
 // HandleEventMutexSynced handles an incoming event
@@ -28,34 +31,73 @@ func (s *State) HandleEventChannelSynced(shardID int, eventInterface interface{}
 // Use this as opposed to HandleEventChannelSynced
 // if you need make sure the state has been updated by the time this returns
 func (s *State) HandleEventMutexSynced(shardID int, eventInterface interface{}) error {
-	if !s.handleEventPreCheck(shardID, eventInterface) {
-		return nil
+	if handle, err := s.handleEventPreCheck(shardID, eventInterface); !handle {
+		return err
 	}
 
 	w := s.shards[shardID]
 	w.MU.Lock()
 	defer w.MU.Unlock()
 
+	// Close may have been called while waiting for the lock
+	if s.closed() {
+		return ErrStateClosed
+	}
+
 	return w.handleEvent(eventInterface)
 }
 
+// HandleEventMutexSyncedResult is the same as HandleEventMutexSynced, but also returns the changes made to the state by the event
+// The old objects in the result are read in the same transaction that they were changed in,
+// so they're the exact objects that were in state before the event (e.g the content of a message before it was deleted)
+func (s *State) HandleEventMutexSyncedResult(shardID int, eventInterface interface{}) (*EventResult, error) {
+	if handle, err := s.handleEventPreCheck(shardID, eventInterface); !handle {
+		return &EventResult{}, err
+	}
+
+	w := s.shards[shardID]
+	w.MU.Lock()
+	defer w.MU.Unlock()
+
+	if s.closed() {
+		return &EventResult{}, ErrStateClosed
+	}
+
+	w.captureChanges = true
+	err := w.handleEvent(eventInterface)
+
+	result := &EventResult{Changes: w.capturedChanges}
+	w.captureChanges = false
+	w.capturedChanges = nil
+
+	return result, err
+}
+
 // HandleEventNoSync handles an incoming event
 //
 // Use this as opposed to mutex synced and channel synced when you provide your own synchronization
 // if this is called by 2 goroutines at once then the state gets corrupted
 func (s *State) HandleEventNoSync(shardID int, eventInterface interface{}) error {
-	if !s.handleEventPreCheck(shardID, eventInterface) {
-		return nil
+	if handle, err := s.handleEventPreCheck(shardID, eventInterface); !handle {
+		return err
 	}
 
 	// Send the event to the proper worker
 	return s.shards[shardID].handleEvent(eventInterface)
 }
 
-func (s *State) handleEventPreCheck(shardID int, eventInterface interface{}) bool {
-	if _, ok := eventInterface.(*discordgo.Event); ok {
+// handleEventPreCheck returns false if the event should not be passed on to the worker, with ErrStateClosed if the state was closed
+func (s *State) handleEventPreCheck(shardID int, eventInterface interface{}) (bool, error) {
+	if s.closed() {
+		return false, ErrStateClosed
+	}
+
+	if evt, ok := eventInterface.(*discordgo.Event); ok {
 		// Fast path this since this is sent for every single event
-		return false
+		// With discordgo.Session.SyncEvents this is sent after the typed event, so the sequence number is the one of the last event passed to the state
+		// (see Options.KeepStateOnStart)
+		s.trackSequence(shardID, evt)
+		return false, nil
 	}
 
 	if s.numShards <= shardID {
@@ -63,14 +105,37 @@ func (s *State) handleEventPreCheck(shardID int, eventInterface interface{}) boo
 		panic("ShardID is higher than count passed to state")
 	}
 
-	return true
+	return true, nil
+}
+
+// closed returns true if State.Close has been called
+func (s *State) closed() bool {
+	select {
+	case <-s.stopChan:
+		return true
+	default:
+		return false
+	}
 }
 
 func (w *shardWorker) run() {
+	defer w.State.workersWG.Done()
+
 	for {
 		select {
 		case <-w.State.stopChan:
-			return
+			// Handle the events still queued up so that the state matches the sequence number saved on close
+			for {
+				select {
+				case event := <-w.eventChan:
+					err := w.handleEvent(event)
+					if err != nil {
+						w.State.opts.Logger.LogError("Failed handling event: ", err)
+					}
+				default:
+					return
+				}
+			}
 		case event := <-w.eventChan:
 			err := w.handleEvent(event)
 			if err != nil {
@@ -106,7 +171,12 @@ func (w *shardWorker) handleEvent(eventInterface interface{}) error {
 	case *discordgo.GuildUpdate:
 		err = w.GuildUpdate(event.Guild)
 	case *discordgo.GuildDelete:
-		err = w.GuildDelete(event.Guild.ID)
+		if event.Unavailable {
+			// Outage, keep the data and only mark it as unavailable
+			err = w.GuildUnavailable(event.Guild)
+		} else {
+			err = w.GuildDelete(event.Guild.ID)
+		}
 
 	// Members
 	case *discordgo.GuildMemberAdd:
@@ -124,6 +194,11 @@ func (w *shardWorker) handleEvent(eventInterface interface{}) error {
 			return nil
 		}
 		err = w.MemberRemove(nil, event.Member.GuildID, event.Member.User.ID, true)
+	case *discordgo.GuildMembersChunk:
+		if !w.State.opts.TrackMembers {
+			return nil
+		}
+		err = w.MembersChunk(event)
 
 	// Roles
 	case *discordgo.GuildRoleCreate:
@@ -175,6 +250,26 @@ func (w *shardWorker) handleEvent(eventInterface interface{}) error {
 			return nil
 		}
 		err = w.MessageDelete(nil, event.ChannelID, event.ID)
+	case *discordgo.MessageDeleteBulk:
+		if !w.State.opts.TrackMessages {
+			return nil
+		}
+		err = w.MessageDeleteBulk(nil, event.ChannelID, event.Messages)
+	case *discordgo.MessageReactionAdd:
+		if !w.State.opts.TrackMessages {
+			return nil
+		}
+		err = w.ReactionAdd(nil, event.MessageReaction)
+	case *discordgo.MessageReactionRemove:
+		if !w.State.opts.TrackMessages {
+			return nil
+		}
+		err = w.ReactionRemove(nil, event.MessageReaction)
+	case *discordgo.MessageReactionRemoveAll:
+		if !w.State.opts.TrackMessages {
+			return nil
+		}
+		err = w.ReactionRemoveAll(nil, event.ChannelID, event.MessageID)
 
 	// Misc
 	case *discordgo.GuildEmojisUpdate:
@@ -203,6 +298,10 @@ func (w *shardWorker) HandleReady(r *discordgo.Ready) error {
 	w.State.memoryState.User = r.User
 	w.State.memoryState.Unlock()
 
+	w.sessionMU.Lock()
+	w.sessionID = r.SessionID
+	w.sessionMU.Unlock()
+
 	// Handle the initial load
 	err := w.setKey(nil, KeySelfUser, r.User)
 	if err != nil {
@@ -216,11 +315,30 @@ func (w *shardWorker) HandleReady(r *discordgo.Ready) error {
 		}
 	}
 
-	return nil
+	if w.State.opts.TrackChannels {
+		err = w.update(func(txn Txn) error {
+			for _, c := range r.PrivateChannels {
+				err := w.ChannelCreateUpdate(txn, c, false)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return err
 }
 
 // GuildCreate adds a guild to the state
+// If the guild is already in state (e.g it was unavailable) it's merged with the stored one, see mergeGuildCreate
+// Unavailable guilds (e.g the ones in the ready payload) are only marked as unavailable, see GuildUnavailable
 func (w *shardWorker) GuildCreate(g *discordgo.Guild) error {
+	if g.Unavailable {
+		return w.GuildUnavailable(g)
+	}
+
 	var gCopy = new(discordgo.Guild)
 	*gCopy = *g
 
@@ -229,24 +347,68 @@ func (w *shardWorker) GuildCreate(g *discordgo.Guild) error {
 	gCopy.VoiceStates = nil
 
 	started := time.Now()
-	err := w.State.RetryUpdate(func(txn *badger.Txn) error {
+	err := w.update(func(txn Txn) error {
+		old, err := w.guild(txn, g.ID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		if old != nil {
+			err = w.State.fillGuild(txn, old)
+			if err != nil {
+				return err
+			}
+
+			err = w.mergeGuildCreate(txn, gCopy, old)
+			if err != nil {
+				return err
+			}
+		}
+
+		w.addChange(&GuildChange{GuildID: g.ID, Old: old, New: gCopy})
+
 		// Handle the initial load
-		err := w.setKey(txn, KeyGuild(g.ID), gCopy)
+		err = w.setGuild(txn, gCopy)
 		if err != nil {
 			return err
 		}
 
-		// Load channels to global registry
+		if gCopy.Roles != nil {
+			err = w.setGuildRoles(txn, g.ID, gCopy.Roles)
+			if err != nil {
+				return err
+			}
+		}
+
+		if gCopy.Emojis != nil {
+			err = w.setGuildEmojis(txn, g.ID, gCopy.Emojis)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = txn.Delete(KeyGuildUnavailable(g.ID))
+		if err != nil {
+			return err
+		}
+
+		// Load channels to global registry, and add all of them to the guild
 		for _, c := range g.Channels {
 			c.GuildID = g.ID
 			err := w.ChannelCreateUpdate(txn, c, false)
 			if err != nil {
 				return err
 			}
+
+			err = txn.Set(KeyGuildChannel(g.ID, c.ID), []byte{})
+			if err != nil {
+				return err
+			}
 		}
 
 		// Load voice states
 		for _, vs := range g.VoiceStates {
+			vs.GuildID = g.ID
 			err := w.VoiceStateUpdate(txn, vs)
 			if err != nil {
 				return err
@@ -255,9 +417,17 @@ func (w *shardWorker) GuildCreate(g *discordgo.Guild) error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
 	if w.State.opts.TrackMembers {
-		err = w.LoadMembers(g.ID, g.Members)
+		_, err = w.LoadMembers(g.ID, g.Members)
+		if err != nil {
+			return err
+		}
+
+		err = w.initMemberLoadProgress(g)
 		if err != nil {
 			return err
 		}
@@ -278,12 +448,13 @@ func (w *shardWorker) GuildCreate(g *discordgo.Guild) error {
 }
 
 // LoadMembers Loads the members using multiple transactions to avoid going above the tx limit
-func (w *shardWorker) LoadMembers(gID string, members []*discordgo.Member) error {
+// Returns the number of members that were not in state before, the member load progress is not updated
+func (w *shardWorker) LoadMembers(gID string, members []*discordgo.Member) (added int, err error) {
 	i := 0
 
 	for {
 
-		err := w.State.RetryUpdate(func(txn *badger.Txn) error {
+		err = w.update(func(txn Txn) error {
 			// Update the members until we either have gone through the member slice or
 			// we have updates more than 1k members
 			startedI := i
@@ -293,11 +464,15 @@ func (w *shardWorker) LoadMembers(gID string, members []*discordgo.Member) error
 				m := members[iCop]
 				m.GuildID = gID
 
-				err := w.MemberUpdate(txn, m)
+				isNew, err := w.memberUpdate(txn, m)
 				if err != nil {
 					return err
 				}
 
+				if isNew {
+					added++
+				}
+
 				if iCop-startedI >= 1000 {
 					i = iCop + 1
 					return nil
@@ -310,12 +485,12 @@ func (w *shardWorker) LoadMembers(gID string, members []*discordgo.Member) error
 		})
 
 		if err != nil {
-			return err
+			return
 		}
 
 		// Also done
 		if i >= len(members) {
-			return nil
+			return
 		}
 	}
 }
@@ -326,7 +501,7 @@ func (w *shardWorker) LoadPresences(presences []*discordgo.Presence) error {
 
 	for {
 
-		err := w.State.RetryUpdate(func(txn *badger.Txn) error {
+		err := w.update(func(txn Txn) error {
 			// Update the presences until we either have gone through the presence slice or
 			// we have updated more than 1k presences
 			startedI := i
@@ -361,47 +536,72 @@ func (w *shardWorker) LoadPresences(presences []*discordgo.Presence) error {
 	}
 }
 
+// GuildUpdate updates the guild in state, see guildUpdateMergePolicy for how the fields are updated
 func (w *shardWorker) GuildUpdate(g *discordgo.Guild) error {
-	err := w.State.RetryUpdate(func(txn *badger.Txn) error {
+	err := w.update(func(txn Txn) error {
 		current, err := w.guild(txn, g.ID)
 		if err != nil {
 			return errors.WithMessage(err, "GuildUpdate")
 		}
 
-		current.Name = g.Name
-		current.Icon = g.Icon
-		current.Splash = g.Splash
-		current.OwnerID = g.OwnerID
-		current.Region = g.Region
-		current.AfkTimeout = g.AfkTimeout
-		current.AfkChannelID = g.AfkChannelID
-		current.EmbedEnabled = g.EmbedEnabled
-		current.EmbedChannelID = g.EmbedChannelID
-		current.VerificationLevel = g.VerificationLevel
-		current.DefaultMessageNotifications = g.DefaultMessageNotifications
+		if w.trackChanges() {
+			err = w.State.fillGuild(txn, current)
+			if err != nil {
+				return err
+			}
 
-		return w.setKey(txn, KeyGuild(g.ID), current)
+			old := *current
+			w.addChange(&GuildChange{GuildID: g.ID, Old: &old, New: current})
+		}
+
+		guildUpdateMergePolicy.merge(current, g)
+
+		return w.setGuild(txn, current)
 	})
 
 	return err
 }
 
-// GuildDelete removes a guild from the state
+// GuildDelete removes a guild and everything belonging to it (members, channels, messages...) from the state, see State.PurgeGuild
 func (w *shardWorker) GuildDelete(guildID string) error {
-	return w.State.RetryUpdate(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(KeyGuild(guildID)))
+	old, err := w.State.Guild(guildID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	err = w.State.purgeGuildData(guildID)
+	if err != nil {
+		return err
+	}
+
+	// Deleted last so that the purge can be retried with PurgeGuild if it failed partway
+	return w.update(func(txn Txn) error {
+		if old != nil {
+			w.addChange(&GuildChange{GuildID: guildID, Old: old})
+		}
+
+		return txn.Delete(KeyGuild(guildID))
 	})
 }
 
-// MemberAdd will increment membercount and update the member,
-// if you call this on members already in the count, your membercount will be off
-func (w *shardWorker) MemberAdd(txn *badger.Txn, m *discordgo.Member, updateCount bool) error {
+// MemberAdd will increment membercount if "updateCount" and update the member,
+// the count is not incremented if the member is already in state (e.g the event was replayed after a resume)
+func (w *shardWorker) MemberAdd(txn Txn, m *discordgo.Member, updateCount bool) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.MemberAdd(txn, m, updateCount)
 		})
 	}
 
+	if updateCount {
+		_, err := txn.Get(KeyGuildMember(m.GuildID, m.User.ID))
+		if err == nil {
+			updateCount = false
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+
 	if updateCount {
 		guild, err := w.guild(txn, m.GuildID)
 		if err != nil {
@@ -418,87 +618,162 @@ func (w *shardWorker) MemberAdd(txn *badger.Txn, m *discordgo.Member, updateCoun
 }
 
 // MemberUpdate updates the current stored state of said member
-func (w *shardWorker) MemberUpdate(txn *badger.Txn, m *discordgo.Member) error {
-	return w.setKey(txn, KeyGuildMember(m.GuildID, m.User.ID), m)
+func (w *shardWorker) MemberUpdate(txn Txn, m *discordgo.Member) error {
+	if txn == nil {
+		return w.update(func(txn Txn) error {
+			return w.MemberUpdate(txn, m)
+		})
+	}
+
+	added, err := w.memberUpdate(txn, m)
+	if err != nil {
+		return err
+	}
+
+	if added {
+		return w.addLoadedMembers(txn, m.GuildID, 1)
+	}
+
+	return nil
+}
+
+// memberUpdate stores the member, returning true if it was not in state before
+func (w *shardWorker) memberUpdate(txn Txn, m *discordgo.Member) (added bool, err error) {
+	// The old member is needed to update the indexes
+	old, err := w.guildMember(txn, m.GuildID, m.User.ID)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+
+	err = w.updateMemberIndexes(txn, m.GuildID, m.User.ID, old, m)
+	if err != nil {
+		return false, errors.WithMessage(err, "MemberIndexes")
+	}
+
+	w.addChange(&MemberChange{GuildID: m.GuildID, UserID: m.User.ID, Old: old, New: m})
+
+	return old == nil, w.setKey(txn, KeyGuildMember(m.GuildID, m.User.ID), m)
 }
 
 // MemberRemove will decrement membercount if "updateCount" and remove the member form state
-func (w *shardWorker) MemberRemove(txn *badger.Txn, guildID, userID string, updateCount bool) error {
+// If the member is not in state the count is only decremented if not all the members of the guild has been loaded (see GuildMembersLoaded),
+// otherwise it's assumed that the member was already removed
+func (w *shardWorker) MemberRemove(txn Txn, guildID, userID string, updateCount bool) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.MemberRemove(txn, guildID, userID, updateCount)
 		})
 	}
 
+	old, err := w.guildMember(txn, guildID, userID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	if old == nil && updateCount {
+		updateCount, err = w.membersPartiallyLoaded(txn, guildID)
+		if err != nil {
+			return err
+		}
+	}
+
 	if updateCount {
 		guild, err := w.guild(txn, guildID)
 		if err != nil {
 			return errors.WithMessage(err, "Guild")
 		}
-		guild.MemberCount--
+
+		if guild.MemberCount > 0 {
+			guild.MemberCount--
+		}
+
 		err = w.setKey(txn, KeyGuild(guildID), guild)
 		if err != nil {
 			return errors.WithMessage(err, "SetGuild")
 		}
 	}
 
+	if old == nil {
+		// Not in state
+		return nil
+	}
+
+	err = w.updateMemberIndexes(txn, guildID, userID, old, nil)
+	if err != nil {
+		return errors.WithMessage(err, "MemberIndexes")
+	}
+
+	w.addChange(&MemberChange{GuildID: guildID, UserID: userID, Old: old})
+
+	err = w.addLoadedMembers(txn, guildID, -1)
+	if err != nil {
+		return err
+	}
+
 	return txn.Delete([]byte(KeyGuildMember(guildID, userID)))
 }
 
 // ChannelCreateUpdate creates or updates a channel in the state
-// if addtoguild is set, it will add and update it on the actual guild object aswell
-func (w *shardWorker) ChannelCreateUpdate(txn *badger.Txn, channel *discordgo.Channel, addToGuild bool) error {
+// if addtoguild is set, it will add it to the channels of the guild aswell (all guild channel types, not private channels)
+func (w *shardWorker) ChannelCreateUpdate(txn Txn, channel *discordgo.Channel, addToGuild bool) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.ChannelCreateUpdate(txn, channel, addToGuild)
 		})
 	}
 
-	// Update the channels object on the guild
-	if channel.Type == discordgo.ChannelTypeGuildText && addToGuild {
-		guild, err := w.guild(txn, channel.GuildID)
+	addToGuild = addToGuild && channel.GuildID != "" && !isPrivateChannel(channel)
+
+	var old *discordgo.Channel
+	if addToGuild || w.trackChanges() {
+		var err error
+		old, err = w.channel(txn, channel.ID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	// Add it to the channels of the guild
+	if addToGuild {
+		err := w.guildExists(txn, channel.GuildID)
 		if err != nil {
 			return errors.WithMessage(err, "ChannelUpdate")
 		}
 
-		found := false
-		for i, v := range guild.Channels {
-			if v.ID == channel.ID {
-				if channel.PermissionOverwrites == nil {
-					channel.PermissionOverwrites = v.PermissionOverwrites
-				}
-
-				guild.Channels[i] = channel
-				found = true
-				break
-			}
+		if old != nil && channel.PermissionOverwrites == nil {
+			channel.PermissionOverwrites = old.PermissionOverwrites
 		}
 
-		if !found {
-			guild.Channels = append(guild.Channels, channel)
+		err = txn.Set(KeyGuildChannel(channel.GuildID, channel.ID), []byte{})
+		if err != nil {
+			return err
 		}
+	}
 
-		err = w.setKey(txn, KeyGuild(guild.ID), guild)
+	if isPrivateChannel(channel) {
+		err := w.setDMChannelIndexes(txn, channel)
 		if err != nil {
-			return err
+			return errors.WithMessage(err, "DMChannelIndexes")
 		}
 	}
 
+	w.addChange(&ChannelChange{GuildID: channel.GuildID, ChannelID: channel.ID, Old: old, New: channel})
+
 	// Update the global entry
 	return w.setKey(txn, KeyChannel(channel.ID), channel)
 }
 
 // ChannelDelete removes a channel from state
-func (w *shardWorker) ChannelDelete(txn *badger.Txn, channelID string) error {
+func (w *shardWorker) ChannelDelete(txn Txn, channelID string) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.ChannelDelete(txn, channelID)
 		})
 	}
 
 	channel, err := w.channel(txn, channelID)
 	if err != nil {
-		if err != badger.ErrKeyNotFound {
+		if err != ErrNotFound {
 			return err
 		}
 
@@ -506,190 +781,258 @@ func (w *shardWorker) ChannelDelete(txn *badger.Txn, channelID string) error {
 		return nil
 	}
 
-	// Update the channels object on the guild
-	if channel.Type == discordgo.ChannelTypeGuildText {
-		guild, err := w.guild(txn, channel.GuildID)
+	// Remove it from the channels of the guild
+	if channel.GuildID != "" {
+		err = txn.Delete(KeyGuildChannel(channel.GuildID, channelID))
 		if err != nil {
-			return errors.WithMessage(err, "ChannelCreateUpdate")
-		}
-
-		for i, v := range guild.Channels {
-			if v.ID == channel.ID {
-				guild.Channels = append(guild.Channels[:i], guild.Channels[i+1:]...)
-				break
-			}
+			return err
 		}
+	}
 
-		err = w.setKey(txn, KeyGuild(guild.ID), guild)
+	if isPrivateChannel(channel) {
+		err = w.deleteDMChannelIndexes(txn, channel)
 		if err != nil {
-			return err
+			return errors.WithMessage(err, "DMChannelIndexes")
 		}
 	}
 
+	w.addChange(&ChannelChange{GuildID: channel.GuildID, ChannelID: channelID, Old: channel})
+
 	// Update the global entry
 	return txn.Delete([]byte(KeyChannel(channelID)))
 }
 
 // RoleCreateUpdate creates or updates a role in the state
 // These roles are actually on the guild at the moment
-func (w *shardWorker) RoleCreateUpdate(txn *badger.Txn, guildID string, role *discordgo.Role) error {
+func (w *shardWorker) RoleCreateUpdate(txn Txn, guildID string, role *discordgo.Role) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.RoleCreateUpdate(txn, guildID, role)
 		})
 	}
 
-	// Update the roles slice on the guild
-	guild, err := w.guild(txn, guildID)
+	err := w.guildExists(txn, guildID)
 	if err != nil {
 		return errors.WithMessage(err, "Guild")
 	}
 
-	found := false
-	for i, v := range guild.Roles {
-		if v.ID == role.ID {
-			guild.Roles[i] = role
-			found = true
-			break
+	if w.trackChanges() {
+		old, err := w.State.GuildRoleWithTxn(txn, guildID, role.ID)
+		if err != nil && err != ErrNotFound {
+			return err
 		}
-	}
 
-	if !found {
-		guild.Roles = append(guild.Roles, role)
+		w.addChange(&RoleChange{GuildID: guildID, RoleID: role.ID, Old: old, New: role})
 	}
 
-	err = w.setKey(txn, KeyGuild(guild.ID), guild)
-	if err != nil {
-		return err
-	}
-
-	return err
+	return w.setKey(txn, KeyGuildRole(guildID, role.ID), role)
 }
 
 // RoleDelete removes a role from state
-func (w *shardWorker) RoleDelete(txn *badger.Txn, guildID, roleID string) error {
+// The role member index is cleaned up in separate transactions if txn is nil, as a role can have a lot of members
+func (w *shardWorker) RoleDelete(txn Txn, guildID, roleID string) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
-			return w.RoleDelete(txn, guildID, roleID)
+		err := w.update(func(txn Txn) error {
+			return w.roleDelete(txn, guildID, roleID)
 		})
+		if err != nil {
+			return err
+		}
+
+		return w.State.deleteKeysWithPrefixBatched(KeyRoleMembersIteratorPrefix(guildID, roleID))
 	}
 
-	guild, err := w.guild(txn, guildID)
+	err := w.roleDelete(txn, guildID, roleID)
 	if err != nil {
-		return errors.WithMessage(err, "Guild")
+		return err
 	}
 
-	for i, v := range guild.Roles {
-		if v.ID == roleID {
-			guild.Roles = append(guild.Roles[:i], guild.Roles[i+1:]...)
-			break
-		}
+	return deleteKeysWithPrefix(txn, KeyRoleMembersIteratorPrefix(guildID, roleID))
+}
+
+func (w *shardWorker) roleDelete(txn Txn, guildID, roleID string) error {
+	err := w.guildExists(txn, guildID)
+	if err != nil {
+		return errors.WithMessage(err, "Guild")
 	}
 
-	err = w.setKey(txn, KeyGuild(guild.ID), guild)
+	old, err := w.State.GuildRoleWithTxn(txn, guildID, roleID)
 	if err != nil {
-		return errors.WithMessage(err, "SetGuild")
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
 	}
 
-	return nil
+	w.addChange(&RoleChange{GuildID: guildID, RoleID: roleID, Old: old})
+	return txn.Delete(KeyGuildRole(guildID, roleID))
 }
 
-func (w *shardWorker) MessageCreateUpdate(txn *badger.Txn, newMsg *discordgo.Message) error {
+func (w *shardWorker) MessageCreateUpdate(txn Txn, newMsg *discordgo.Message) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.MessageCreateUpdate(txn, newMsg)
 		})
 	}
 
+	var old *discordgo.Message
 	msg, _, err := w.channelMessage(txn, newMsg.ChannelID, newMsg.ID)
 	if err == nil && msg != nil {
-		if newMsg.Content != "" {
-			msg.Content = newMsg.Content
-		}
-		if newMsg.EditedTimestamp != "" {
-			msg.EditedTimestamp = newMsg.EditedTimestamp
-		}
-		if newMsg.Mentions != nil {
-			msg.Mentions = newMsg.Mentions
-		}
-		if newMsg.Embeds != nil {
-			msg.Embeds = newMsg.Embeds
-		}
-		if newMsg.Attachments != nil {
-			msg.Attachments = newMsg.Attachments
-		}
-		if newMsg.Timestamp != "" {
-			msg.Timestamp = newMsg.Timestamp
-		}
-		if newMsg.Author != nil {
-			msg.Author = newMsg.Author
+		if w.trackChanges() {
+			cop := *msg
+			old = &cop
 		}
+
+		messageUpdateMergePolicy.merge(msg, newMsg)
 	} else {
 		msg = newMsg
 	}
 
+	guildID := w.messageGuildID(txn, msg)
+
+	// Always set the index entries, so that they get the same ttl as the message
+	err = w.setMessageIndexes(txn, guildID, msg)
+	if err != nil {
+		return errors.WithMessage(err, "MessageIndexes")
+	}
+
+	w.addChange(&MessageChange{
+		GuildID:   guildID,
+		ChannelID: msg.ChannelID,
+		MessageID: msg.ID,
+		Old:       old,
+		New:       msg,
+	})
+
 	return w.setKeyWithTTL(txn, KeyChannelMessage(newMsg.ChannelID, newMsg.ID), msg, w.State.opts.MessageTTL)
 }
 
-func (w *shardWorker) MessageDelete(txn *badger.Txn, channelID, messageID string) error {
+func (w *shardWorker) MessageDelete(txn Txn, channelID, messageID string) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.MessageDelete(txn, channelID, messageID)
 		})
 	}
 
+	return w.messageDelete(txn, channelID, messageID, MessageFlagDeleted)
+}
+
+// MessageDeleteBulk deletes all the messages in a single transaction
+// with KeepDeletedMessages they're flagged with MessageFlagBulkDeleted aswell
+func (w *shardWorker) MessageDeleteBulk(txn Txn, channelID string, messageIDs []string) error {
+	if txn == nil {
+		return w.update(func(txn Txn) error {
+			return w.MessageDeleteBulk(txn, channelID, messageIDs)
+		})
+	}
+
+	for _, v := range messageIDs {
+		err := w.messageDelete(txn, channelID, v, MessageFlagDeleted|MessageFlagBulkDeleted)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// messageDelete deletes a message, or sets deleteFlags on it if KeepDeletedMessages is enabled
+func (w *shardWorker) messageDelete(txn Txn, channelID, messageID string, deleteFlags MessageFlag) error {
 	if !w.State.opts.KeepDeletedMessages {
+		old, _, err := w.channelMessage(txn, channelID, messageID)
+		if err != nil {
+			if err != ErrNotFound {
+				return err
+			}
+		} else {
+			guildID := w.messageGuildID(txn, old)
+
+			err = w.deleteMessageIndexes(txn, guildID, old)
+			if err != nil {
+				return errors.WithMessage(err, "MessageIndexes")
+			}
+
+			w.addChange(&MessageChange{GuildID: guildID, ChannelID: channelID, MessageID: messageID, Old: old})
+		}
+
+		if w.State.opts.TrackReactionUsers {
+			err := deleteKeysWithPrefix(txn, KeyMessageReactionsIteratorPrefix(channelID, messageID))
+			if err != nil {
+				return err
+			}
+		}
+
 		return txn.Delete([]byte(KeyChannelMessage(channelID, messageID)))
 	}
 
-	current, flags, err := w.channelMessage(txn, channelID, messageID)
+	// The item is needed to keep the expiry of the message, so it expires along with its indexes
+	current, item, err := w.channelMessageItem(txn, channelID, messageID)
+	if err != nil || current == nil {
+		return err
+	}
+
+	flags := MessageFlag(item.UserMeta())
+	if flags&MessageFlagDeleted == 0 && w.trackChanges() {
+		w.addChange(&MessageChange{GuildID: w.messageGuildID(txn, current), ChannelID: channelID, MessageID: messageID, Old: current})
+	}
+
+	encoded, err := w.State.encodeData(w.buffer, w.encoder, current)
 	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			return nil
-		}
 		return err
 	}
 
-	flags |= MessageFlagDeleted
-	return w.setKeyWithMeta(txn, KeyChannelMessage(channelID, messageID), current, byte(flags))
+	flags |= deleteFlags
+	return setRawEntry(txn, KeyChannelMessage(channelID, messageID), encoded, byte(flags), item.ExpiresAt())
 }
 
-// RoleDelete removes a role from state
-func (w *shardWorker) EmojisUpdate(txn *badger.Txn, guildID string, emojis []*discordgo.Emoji) error {
+// EmojisUpdate replaces the emojis of a guild, emojis is the full list of emojis in the guild
+// The diff is available through the EmojisChange, see EventResult.EmojisChange
+func (w *shardWorker) EmojisUpdate(txn Txn, guildID string, emojis []*discordgo.Emoji) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.EmojisUpdate(txn, guildID, emojis)
 		})
 	}
 
-	guild, err := w.guild(txn, guildID)
+	err := w.guildExists(txn, guildID)
 	if err != nil {
 		return errors.WithMessage(err, "Guild")
 	}
 
-OUTER:
-	for _, newEmoji := range emojis {
-		for _, v := range guild.Emojis {
-			if v.ID == newEmoji.ID {
-				continue OUTER
-			}
-		}
+	var old []*discordgo.Emoji
+	err = w.State.IterateGuildEmojis(txn, guildID, func(e *discordgo.Emoji) bool {
+		old = append(old, e)
+		return true
+	})
+	if err != nil {
+		return err
+	}
 
-		guild.Emojis = append(guild.Emojis, newEmoji)
+	change := newEmojisChange(guildID, old, emojis)
+	for _, v := range change.Removed {
+		err = txn.Delete(KeyGuildEmoji(guildID, v.ID))
+		if err != nil {
+			return err
+		}
 	}
 
-	err = w.setKey(txn, KeyGuild(guild.ID), guild)
-	if err != nil {
-		return errors.WithMessage(err, "SetGuild")
+	// Other fields than the name may have changed aswell, so all of them are updated
+	for _, v := range emojis {
+		err = w.setKey(txn, KeyGuildEmoji(guildID, v.ID), v)
+		if err != nil {
+			return errors.WithMessage(err, "SetEmoji")
+		}
 	}
 
+	w.addChange(change)
+
 	return nil
 }
 
 // PresenceUpdate will add or update an existing presence in state
-func (w *shardWorker) PresenceAddUpdate(txn *badger.Txn, forceAdd bool, p *discordgo.Presence) error {
+func (w *shardWorker) PresenceAddUpdate(txn Txn, forceAdd bool, p *discordgo.Presence) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.PresenceAddUpdate(txn, forceAdd, p)
 		})
 	}
@@ -698,47 +1041,64 @@ func (w *shardWorker) PresenceAddUpdate(txn *badger.Txn, forceAdd bool, p *disco
 	if !forceAdd {
 		var err error
 		current, err = w.presence(txn, p.User.ID)
-		if err != nil && err != badger.ErrKeyNotFound {
+		if err != nil && err != ErrNotFound {
 			return err
 		}
 	}
 
+	var old *discordgo.Presence
 	if current != nil {
-		// update the existing one
-		if p.User.Username != "" {
-			current.User.Username = p.User.Username
-		}
-		if p.User.Discriminator != "" {
-			current.User.Discriminator = p.User.Discriminator
-		}
-		if p.User.Avatar != "" {
-			current.User.Avatar = p.User.Avatar
-		}
-		if p.Status != "" {
-			current.Status = p.Status
+		if w.trackChanges() {
+			cop := *current
+			userCop := *current.User
+			cop.User = &userCop
+			old = &cop
 		}
 
-		current.Game = p.Game
-		current.Nick = p.Nick
+		// update the existing one
+		presenceUpdateMergePolicy.merge(current, p)
+		presenceUserMergePolicy.merge(current.User, p.User)
 	} else {
 		current = p
 	}
 
+	w.addChange(&PresenceChange{UserID: p.User.ID, Old: old, New: current})
+
 	return w.setKey(txn, KeyPresence(p.User.ID), current)
 }
 
 // VoiceStateUpdate will add/update/delete a voice state in state
-func (w *shardWorker) VoiceStateUpdate(txn *badger.Txn, vs *discordgo.VoiceState) error {
+func (w *shardWorker) VoiceStateUpdate(txn Txn, vs *discordgo.VoiceState) error {
 	if txn == nil {
-		return w.State.RetryUpdate(func(txn *badger.Txn) error {
+		return w.update(func(txn Txn) error {
 			return w.VoiceStateUpdate(txn, vs)
 		})
 	}
 
+	// The old voice state is needed to update the voice channel index on moves
+	old, err := w.voiceState(txn, vs.GuildID, vs.UserID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	err = w.updateVoiceStateIndexes(txn, old, vs)
+	if err != nil {
+		return errors.WithMessage(err, "VoiceStateIndexes")
+	}
+
+	change := &VoiceStateChange{GuildID: vs.GuildID, UserID: vs.UserID, Old: old, New: vs}
+	if vs.ChannelID == "" {
+		change.New = nil
+	}
+
+	if change.Old != nil || change.New != nil {
+		w.addChange(change)
+	}
+
 	if vs.ChannelID == "" {
 		// Left the channel
 		err := txn.Delete(KeyVoiceState(vs.GuildID, vs.UserID))
-		if err != badger.ErrKeyNotFound && err != nil {
+		if err != ErrNotFound && err != nil {
 			return err
 		}
 	} else {
@@ -747,3 +1107,17 @@ func (w *shardWorker) VoiceStateUpdate(txn *badger.Txn, vs *discordgo.VoiceState
 
 	return nil
 }
+
+// messageGuildID returns the guild the message belongs to, the guild id is not always set on messages so if it's missing it's taken from the channel
+func (w *shardWorker) messageGuildID(txn Txn, msg *discordgo.Message) string {
+	if msg.GuildID != "" {
+		return msg.GuildID
+	}
+
+	channel, err := w.channel(txn, msg.ChannelID)
+	if err != nil {
+		return ""
+	}
+
+	return channel.GuildID
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestGuilds(t *testing.T) {
@@ -215,6 +216,185 @@ func TestChannelMessages(t *testing.T) {
 	}
 }
 
+func TestChannelMessagesTimeRange(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:         NewMemoryStore(),
+		TrackMessages: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	// A message every minute
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := make([]string, 10)
+	for i := range ids {
+		ids[i] = strconv.FormatUint(SnowflakeFromTime(start.Add(time.Duration(i)*time.Minute))+uint64(i), 10)
+		AssertFatal(t, state.shards[0].MessageCreateUpdate(nil, &discordgo.Message{ID: ids[i], ChannelID: "2"}), "failed creating message")
+	}
+
+	// Another channel to make sure it does not go past the channel
+	AssertFatal(t, state.shards[0].MessageCreateUpdate(nil, &discordgo.Message{ID: ids[5], ChannelID: "3"}), "failed creating message")
+
+	assertMessages := func(messages []*MessageWithMeta, err error, expected ...string) {
+		AssertFatal(t, err, "failed retrieving messages")
+
+		if len(messages) != len(expected) {
+			t.Fatalf("unexpected number of messages: %d, expected %d", len(messages), len(expected))
+		}
+
+		for i, v := range messages {
+			if v.ID != expected[i] {
+				t.Errorf("unexpected message %d: %s, expected %s", i, v.ID, expected[i])
+			}
+		}
+	}
+
+	messages, err := state.ChannelMessagesBetween("2", start.Add(2*time.Minute), start.Add(5*time.Minute))
+	assertMessages(messages, err, ids[2], ids[3], ids[4])
+
+	messages, err = state.ChannelMessagesBetween("2", start.Add(-time.Hour), start.Add(time.Hour))
+	assertMessages(messages, err, ids...)
+
+	messages, err = state.ChannelMessagesBefore("2", ids[5], 2)
+	assertMessages(messages, err, ids[4], ids[3])
+
+	messages, err = state.ChannelMessagesBefore("2", ids[1], 0)
+	assertMessages(messages, err, ids[0])
+
+	messages, err = state.ChannelMessagesAfter("2", ids[5], 2)
+	assertMessages(messages, err, ids[6], ids[7])
+
+	messages, err = state.ChannelMessagesAfter("2", ids[9], 0)
+	assertMessages(messages, err)
+
+	// The largest possible id should not wrap around to the start of the channel
+	messages, err = state.ChannelMessagesAfter("2", "18446744073709551615", 0)
+	assertMessages(messages, err)
+
+	// Invalid message ids should not be treated as 0
+	for _, id := range []string{"", "abc"} {
+		if _, err = state.ChannelMessagesAfter("2", id, 0); err == nil {
+			t.Errorf("no error with message id %q after", id)
+		}
+		if _, err = state.ChannelMessagesBefore("2", id, 0); err == nil {
+			t.Errorf("no error with message id %q before", id)
+		}
+	}
+}
+
+func TestMessageDeleteBulk(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		state, err := NewState(1, Options{
+			Store:               NewMemoryStore(),
+			TrackMessages:       true,
+			MessageTTL:          time.Hour,
+			KeepDeletedMessages: keep,
+		})
+		AssertFatal(t, err, "failed creating state")
+
+		for i := 1; i <= 3; i++ {
+			m := &discordgo.Message{ID: strconv.Itoa(i), ChannelID: "2"}
+			AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageCreate{Message: m}), "failed creating message")
+		}
+
+		AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageDeleteBulk{ChannelID: "2", Messages: []string{"1", "2"}}), "failed bulk deleting")
+
+		messages, err := state.LastChannelMessages("2", -1, true)
+		AssertFatal(t, err, "failed retrieving messages")
+
+		if !keep {
+			if len(messages) != 1 || messages[0].ID != "3" {
+				t.Errorf("unexpected messages left after bulk delete: %d", len(messages))
+			}
+		} else {
+			if len(messages) != 3 {
+				t.Fatalf("unexpected messages left after bulk delete with KeepDeletedMessages: %d", len(messages))
+			}
+
+			for _, m := range messages {
+				deleted := m.ID != "3"
+				if m.Deleted != deleted || m.BulkDeleted != deleted {
+					t.Errorf("unexpected flags on message %s: deleted: %t, bulk deleted: %t", m.ID, m.Deleted, m.BulkDeleted)
+				}
+			}
+
+			// The deleted messages should still expire
+			AssertFatal(t, state.Store.View(func(txn Txn) error {
+				item, err := txn.Get(KeyChannelMessage("2", "1"))
+				if err == nil && item.ExpiresAt() == 0 {
+					t.Error("message ttl lost after deleting it")
+				}
+				return err
+			}), "failed retrieving message item")
+		}
+
+		state.Close()
+	}
+}
+
+func TestMessageReactions(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:              NewMemoryStore(),
+		TrackMessages:      true,
+		MessageTTL:         time.Hour,
+		TrackReactionUsers: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.Ready{User: &discordgo.User{ID: "1"}}), "failed handling ready")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageCreate{Message: &discordgo.Message{ID: "3", ChannelID: "2"}}), "failed creating message")
+
+	reaction := func(userID, emoji string) *discordgo.MessageReaction {
+		return &discordgo.MessageReaction{UserID: userID, ChannelID: "2", MessageID: "3", Emoji: discordgo.Emoji{Name: emoji}}
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageReactionAdd{MessageReaction: reaction("1", "a")}), "failed adding reaction")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageReactionAdd{MessageReaction: reaction("5", "a")}), "failed adding reaction")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageReactionAdd{MessageReaction: reaction("5", "a")}), "failed adding duplicate reaction")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageReactionAdd{MessageReaction: reaction("5", "b")}), "failed adding reaction")
+
+	msg, _, err := state.ChannelMessage("2", "3")
+	AssertFatal(t, err, "failed retrieving message")
+	if len(msg.Reactions) != 2 || msg.Reactions[0].Count != 2 || !msg.Reactions[0].Me || msg.Reactions[1].Count != 1 || msg.Reactions[1].Me {
+		t.Fatalf("unexpected reactions: %#v", msg.Reactions)
+	}
+
+	// The message should still expire
+	AssertFatal(t, state.Store.View(func(txn Txn) error {
+		item, err := txn.Get(KeyChannelMessage("2", "3"))
+		if err == nil && item.ExpiresAt() == 0 {
+			t.Error("message ttl lost after adding reactions")
+		}
+		return err
+	}), "failed retrieving message item")
+
+	users, err := state.MessageReactionUsers("2", "3", "a")
+	AssertFatal(t, err, "failed retrieving reaction users")
+	if len(users) != 2 || users[0] != "1" || users[1] != "5" {
+		t.Errorf("unexpected reaction users: %v", users)
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageReactionRemove{MessageReaction: reaction("1", "a")}), "failed removing reaction")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageReactionRemove{MessageReaction: reaction("5", "b")}), "failed removing reaction")
+
+	msg, _, err = state.ChannelMessage("2", "3")
+	AssertFatal(t, err, "failed retrieving message")
+	if len(msg.Reactions) != 1 || msg.Reactions[0].Count != 1 || msg.Reactions[0].Me {
+		t.Fatalf("unexpected reactions after removing: %#v", msg.Reactions)
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageReactionRemoveAll{MessageReaction: reaction("", "")}), "failed removing all reactions")
+
+	msg, _, err = state.ChannelMessage("2", "3")
+	AssertFatal(t, err, "failed retrieving message")
+	users, err = state.MessageReactionUsers("2", "3", "a")
+	AssertFatal(t, err, "failed retrieving reaction users")
+	if len(msg.Reactions) != 0 || len(users) != 0 {
+		t.Errorf("reactions left after removing all: %#v, %v", msg.Reactions, users)
+	}
+}
+
 func TestPresences(t *testing.T) {
 	p := &discordgo.Presence{
 		Nick: "boiman",
@@ -296,7 +476,7 @@ func TestLoadMembers(t *testing.T) {
 		}
 	}
 
-	err := testWorker.LoadMembers("1", members)
+	_, err := testWorker.LoadMembers("1", members)
 	AssertErr(t, err, "Failed loading members")
 
 	n := 0
@@ -308,6 +488,13 @@ func TestLoadMembers(t *testing.T) {
 	if n != len(members) {
 		t.Fatal("Incorrect number of members loaded: ", n)
 	}
+
+	// All of them are in state now
+	added, err := testWorker.LoadMembers("1", members)
+	AssertErr(t, err, "Failed loading members")
+	if added != 0 {
+		t.Error("Members already in state counted as added: ", added)
+	}
 }
 
 func TestLoadPresences(t *testing.T) {
@@ -335,3 +522,196 @@ func TestLoadPresences(t *testing.T) {
 		t.Fatal("Incorrect number of presences loaded: ", n)
 	}
 }
+
+func TestGuildMembersChunk(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:        NewMemoryStore(),
+		TrackMembers: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	members := make([]*discordgo.Member, 1500)
+	for i := 0; i < len(members); i++ {
+		members[i] = &discordgo.Member{
+			User: &discordgo.User{
+				ID: strconv.FormatInt(int64(i+1), 10),
+			},
+		}
+	}
+
+	err = state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1", Large: true, MemberCount: len(members), Members: members[:10]}})
+	AssertFatal(t, err, "failed handling guild create")
+
+	if state.GuildMembersLoaded("1") {
+		t.Fatal("members marked as fully loaded after guild create")
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMembersChunk{GuildID: "1", Members: members[:1000]}), "failed handling chunk")
+
+	progress, err := state.GuildMembersLoadProgress("1")
+	AssertFatal(t, err, "failed retrieving progress")
+	if progress.InitialMembers != 10 || progress.Chunks != 1 || progress.ChunkedMembers != 1000 || progress.FullyLoaded {
+		t.Fatalf("unexpected progress: %#v", progress)
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMembersChunk{GuildID: "1", Members: members[1000:]}), "failed handling chunk")
+	if !state.GuildMembersLoaded("1") {
+		t.Fatal("members not marked as fully loaded after receiving all chunks")
+	}
+
+	n := 0
+	state.IterateGuildMembers(nil, "1", func(m *discordgo.Member) bool {
+		n++
+		return true
+	})
+
+	if n != len(members) {
+		t.Fatal("Incorrect number of members loaded: ", n)
+	}
+}
+
+func TestGuildMembersChunkDuplicates(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:        NewMemoryStore(),
+		TrackMembers: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	members := []*discordgo.Member{{User: &discordgo.User{ID: "1"}}, {User: &discordgo.User{ID: "2"}}, {User: &discordgo.User{ID: "3"}}}
+
+	err = state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1", Large: true, MemberCount: len(members), Members: members[:1]}})
+	AssertFatal(t, err, "failed handling guild create")
+
+	// The same members requested twice
+	for i := 0; i < 2; i++ {
+		AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMembersChunk{GuildID: "1", Members: members[:2]}), "failed handling chunk")
+	}
+
+	if state.GuildMembersLoaded("1") {
+		t.Fatal("members marked as fully loaded after receiving duplicate chunks")
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMembersChunk{GuildID: "1", Members: members[2:]}), "failed handling chunk")
+	if !state.GuildMembersLoaded("1") {
+		t.Fatal("members not marked as fully loaded after receiving all chunks")
+	}
+}
+
+func TestGuildMembersChunkMemberEvents(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:        NewMemoryStore(),
+		TrackMembers: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	members := []*discordgo.Member{{User: &discordgo.User{ID: "1"}}, {User: &discordgo.User{ID: "2"}}, {User: &discordgo.User{ID: "3"}}}
+
+	err = state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1", Large: true, MemberCount: len(members), Members: members[:1]}})
+	AssertFatal(t, err, "failed handling guild create")
+
+	// A member joins and one of the loaded members leaves while the rest are being loaded
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMemberAdd{Member: &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "4"}}}), "failed handling member add")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMemberRemove{Member: &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "1"}}}), "failed handling member remove")
+
+	progress, err := state.GuildMembersLoadProgress("1")
+	AssertFatal(t, err, "failed retrieving progress")
+	if progress.LoadedMembers != 1 || progress.FullyLoaded {
+		t.Fatalf("unexpected progress after member events: %#v", progress)
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMembersChunk{GuildID: "1", Members: members[1:2]}), "failed handling chunk")
+	if state.GuildMembersLoaded("1") {
+		t.Fatal("members marked as fully loaded before receiving all chunks")
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMembersChunk{GuildID: "1", Members: members[2:]}), "failed handling chunk")
+	if !state.GuildMembersLoaded("1") {
+		t.Fatal("members not marked as fully loaded after receiving all chunks")
+	}
+}
+
+func TestGuildMembersLoadedWithoutCount(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:        NewMemoryStore(),
+		TrackMembers: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1"}}), "failed handling guild create")
+	if state.GuildMembersLoaded("1") {
+		t.Error("members marked as fully loaded for a guild without a member count")
+	}
+}
+
+func TestCountsAndMemberCount(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:          NewMemoryStore(),
+		TrackMembers:   true,
+		TrackMessages:  true,
+		TrackPresences: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	member := func(id string) *discordgo.Member {
+		return &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: id}}
+	}
+
+	g := &discordgo.Guild{ID: "1", MemberCount: 2, Members: []*discordgo.Member{member("10"), member("11")}}
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: g}), "failed handling guild create")
+
+	// Replayed events should not make the count drift
+	for i := 0; i < 2; i++ {
+		AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMemberAdd{Member: member("12")}), "failed handling member add")
+	}
+	for i := 0; i < 2; i++ {
+		AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildMemberRemove{Member: member("10")}), "failed handling member remove")
+	}
+
+	stored, err := state.Guild("1")
+	AssertFatal(t, err, "failed retrieving guild")
+	if stored.MemberCount != 2 {
+		t.Errorf("unexpected member count: %d", stored.MemberCount)
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageCreate{Message: &discordgo.Message{ID: "3", ChannelID: "2"}}), "failed handling message create")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.PresenceUpdate{Presence: discordgo.Presence{User: &discordgo.User{ID: "10"}}}), "failed handling presence update")
+
+	assertCount := func(name string, n int, err error, expected int) {
+		AssertFatal(t, err, "failed counting ", name)
+		if n != expected {
+			t.Errorf("unexpected %s count: %d, expected %d", name, n, expected)
+		}
+	}
+
+	n, err := state.CountGuildMembers("1")
+	assertCount("member", n, err, 2)
+	n, err = state.CountGuilds()
+	assertCount("guild", n, err, 1)
+	n, err = state.CountChannelMessages("2")
+	assertCount("message", n, err, 1)
+	n, err = state.CountPresences()
+	assertCount("presence", n, err, 1)
+}
+
+func TestPresenceUpdateBeforeGC(t *testing.T) {
+	state, err := NewState(2, Options{Store: NewMemoryStore(), TrackPresences: true})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	// The filter used to be nil until the first gc tick, panicking here
+	for _, shard := range []int{0, 1} {
+		err = state.HandleEventNoSync(shard, &discordgo.PresenceUpdate{Presence: discordgo.Presence{User: &discordgo.User{ID: "5"}, Status: "online"}})
+		AssertFatal(t, err, "failed handling presence update")
+	}
+
+	p, err := state.Presence("5")
+	AssertFatal(t, err, "failed retrieving presence")
+	if p.Status != "online" {
+		t.Errorf("unexpected status: %q", p.Status)
+	}
+}
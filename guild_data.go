@@ -0,0 +1,172 @@
+package dbstate
+
+import (
+	"encoding/binary"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+)
+
+// The roles, emojis and channel list of guilds are stored under their own keys, so that updating them
+// dosen't require rewriting the whole guild, the guild itself is stored without them
+
+// GuildRoles returns the roles of a guild, sorted by id
+func (s *State) GuildRoles(guildID string) ([]*discordgo.Role, error) {
+	return s.GuildRolesWithTxn(nil, guildID)
+}
+
+// GuildRolesWithTxn is the same as GuildRoles but allows you to pass a transaction
+func (s *State) GuildRolesWithTxn(txn Txn, guildID string) (roles []*discordgo.Role, err error) {
+	err = s.IterateGuildRoles(txn, guildID, func(r *discordgo.Role) bool {
+		roles = append(roles, r)
+		return true
+	})
+	return
+}
+
+// GuildRole returns a role from the state
+func (s *State) GuildRole(guildID, roleID string) (*discordgo.Role, error) {
+	return s.GuildRoleWithTxn(nil, guildID, roleID)
+}
+
+// GuildRoleWithTxn is the same as GuildRole but allows you to pass a transaction
+func (s *State) GuildRoleWithTxn(txn Txn, guildID, roleID string) (st *discordgo.Role, err error) {
+	_, err = s.GetKey(txn, KeyGuildRole(guildID, roleID), &st)
+	return
+}
+
+// GuildEmoji returns a emoji from the state
+func (s *State) GuildEmoji(guildID, emojiID string) (*discordgo.Emoji, error) {
+	return s.GuildEmojiWithTxn(nil, guildID, emojiID)
+}
+
+// GuildEmojiWithTxn is the same as GuildEmoji but allows you to pass a transaction
+func (s *State) GuildEmojiWithTxn(txn Txn, guildID, emojiID string) (st *discordgo.Emoji, err error) {
+	_, err = s.GetKey(txn, KeyGuildEmoji(guildID, emojiID), &st)
+	return
+}
+
+// fillGuild sets the roles, emojis and channels of g from their own keys
+func (s *State) fillGuild(txn Txn, g *discordgo.Guild) error {
+	g.Roles = nil
+	err := s.IterateGuildRoles(txn, g.ID, func(r *discordgo.Role) bool {
+		g.Roles = append(g.Roles, r)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	g.Emojis = nil
+	err = s.IterateGuildEmojis(txn, g.ID, func(e *discordgo.Emoji) bool {
+		g.Emojis = append(g.Emojis, e)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	g.Channels = nil
+	return s.IterateGuildChannels(txn, g.ID, func(c *discordgo.Channel) bool {
+		g.Channels = append(g.Channels, c)
+		return true
+	})
+}
+
+// IterateGuildChannels iterates over the channels of a guild sorted by id, calling f on them
+// if types is not empty only channels of those types are included
+// if f returns false then iteration will stop
+func (s *State) IterateGuildChannels(txn Txn, guildID string, f func(c *discordgo.Channel) bool, types ...discordgo.ChannelType) error {
+	if txn == nil {
+		return s.Store.View(func(txn Txn) error {
+			return s.IterateGuildChannels(txn, guildID, f, types...)
+		})
+	}
+
+	// The guild channel keys are only an index, the channels themselves are the global entries
+	prefix := KeyGuildChannelsIteratorPrefix(guildID)
+
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		channelID := strconv.FormatUint(binary.BigEndian.Uint64(it.Item().Key()[9:]), 10)
+
+		c, err := s.ChannelWithTxn(txn, channelID)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return err
+		}
+
+		if len(types) > 0 && !containsChannelType(types, c.Type) {
+			continue
+		}
+
+		if !f(c) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func containsChannelType(types []discordgo.ChannelType, t discordgo.ChannelType) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setGuild stores the guild without the roles, emojis and channels, see setGuildRoles, setGuildEmojis and ChannelCreateUpdate for those
+func (w *shardWorker) setGuild(txn Txn, g *discordgo.Guild) error {
+	cop := *g
+	cop.Roles = nil
+	cop.Emojis = nil
+	cop.Channels = nil
+
+	return w.setKey(txn, KeyGuild(g.ID), &cop)
+}
+
+// setGuildRoles replaces the stored roles of a guild
+func (w *shardWorker) setGuildRoles(txn Txn, guildID string, roles []*discordgo.Role) error {
+	err := deleteKeysWithPrefix(txn, KeyGuildRolesIteratorPrefix(guildID))
+	if err != nil {
+		return err
+	}
+
+	for _, v := range roles {
+		err = w.setKey(txn, KeyGuildRole(guildID, v.ID), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setGuildEmojis replaces the stored emojis of a guild
+func (w *shardWorker) setGuildEmojis(txn Txn, guildID string, emojis []*discordgo.Emoji) error {
+	err := deleteKeysWithPrefix(txn, KeyGuildEmojisIteratorPrefix(guildID))
+	if err != nil {
+		return err
+	}
+
+	for _, v := range emojis {
+		err = w.setKey(txn, KeyGuildEmoji(guildID, v.ID), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// guildExists returns ErrNotFound if the guild is not in state, without decoding it
+func (w *shardWorker) guildExists(txn Txn, guildID string) error {
+	_, err := txn.Get(KeyGuild(guildID))
+	return err
+}
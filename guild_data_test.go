@@ -0,0 +1,222 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGuildRolesEmojisChannels(t *testing.T) {
+	state, err := NewState(1, Options{Store: NewMemoryStore(), TrackChannels: true, TrackRoles: true})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	g := &discordgo.Guild{
+		ID:       "1",
+		Name:     "roles",
+		Roles:    []*discordgo.Role{{ID: "100", Name: "a"}, {ID: "101", Name: "b"}},
+		Emojis:   []*discordgo.Emoji{{ID: "200", Name: "emoji"}},
+		Channels: []*discordgo.Channel{{ID: "10", Type: discordgo.ChannelTypeGuildText}, {ID: "11", Type: discordgo.ChannelTypeGuildVoice}},
+	}
+
+	events := []interface{}{
+		&discordgo.GuildCreate{Guild: g},
+		&discordgo.GuildRoleUpdate{GuildRole: &discordgo.GuildRole{GuildID: "1", Role: &discordgo.Role{ID: "100", Name: "renamed"}}},
+		&discordgo.GuildRoleCreate{GuildRole: &discordgo.GuildRole{GuildID: "1", Role: &discordgo.Role{ID: "102", Name: "c"}}},
+		&discordgo.GuildRoleDelete{GuildID: "1", RoleID: "101"},
+		&discordgo.ChannelCreate{Channel: &discordgo.Channel{ID: "12", GuildID: "1", Type: discordgo.ChannelTypeGuildText}},
+		&discordgo.ChannelDelete{Channel: &discordgo.Channel{ID: "10", GuildID: "1"}},
+	}
+
+	for _, v := range events {
+		AssertFatal(t, state.HandleEventNoSync(0, v), "failed handling event")
+	}
+
+	// The guild itself should be stored without them
+	var raw *discordgo.Guild
+	_, err = state.GetKey(nil, KeyGuild("1"), &raw)
+	AssertFatal(t, err, "failed retrieving raw guild")
+	if raw.Roles != nil || raw.Emojis != nil || raw.Channels != nil {
+		t.Error("roles, emojis or channels stored on the guild")
+	}
+
+	roles, err := state.GuildRoles("1")
+	AssertFatal(t, err, "failed retrieving roles")
+	if len(roles) != 2 || roles[0].Name != "renamed" || roles[1].ID != "102" {
+		t.Errorf("unexpected roles: %#v", roles)
+	}
+
+	role, err := state.GuildRole("1", "102")
+	AssertFatal(t, err, "failed retrieving role")
+	if role.Name != "c" {
+		t.Errorf("unexpected role: %#v", role)
+	}
+	if _, err = state.GuildRole("1", "101"); err != ErrNotFound {
+		t.Error("deleted role still in state: ", err)
+	}
+
+	guild, err := state.Guild("1")
+	AssertFatal(t, err, "failed retrieving guild")
+	if guild.Name != "roles" || len(guild.Roles) != 2 || len(guild.Emojis) != 1 {
+		t.Errorf("guild not reassembled: %#v", guild)
+	}
+
+	var channels []string
+	for _, v := range guild.Channels {
+		channels = append(channels, v.ID)
+	}
+	if len(channels) != 2 || channels[0] != "11" || channels[1] != "12" {
+		t.Errorf("unexpected guild channels: %v", channels)
+	}
+
+	n := 0
+	err = state.IterateGuilds(nil, func(g *discordgo.Guild) bool {
+		n++
+		if len(g.Roles) != 2 {
+			t.Errorf("guild not reassembled when iterating: %#v", g)
+		}
+		return true
+	})
+	AssertFatal(t, err, "failed iterating guilds")
+	if n != 1 {
+		t.Errorf("iterated over %d guilds", n)
+	}
+}
+
+func TestMigrateV8SplitGuild(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_migrate_v8")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	opts := Options{DBOpts: RecommendedBadgerOptions(dir), KeepStateOnStart: true}
+	state, err := NewState(1, opts)
+	AssertFatal(t, err, "failed creating state")
+
+	// Add a guild the way it was stored before
+	err = state.SetKey(nil, nil, nil, KeyGuild("1"), &discordgo.Guild{
+		ID:       "1",
+		Roles:    []*discordgo.Role{{ID: "100", Name: "a"}},
+		Emojis:   []*discordgo.Emoji{{ID: "200", Name: "emoji"}},
+		Channels: []*discordgo.Channel{{ID: "10", GuildID: "1"}},
+	})
+	AssertFatal(t, err, "failed setting guild")
+	err = state.SetKey(nil, nil, nil, KeyChannel("10"), &discordgo.Channel{ID: "10", GuildID: "1"})
+	AssertFatal(t, err, "failed setting channel")
+
+	meta, err := state.getMeta(nil)
+	AssertFatal(t, err, "failed retrieving meta")
+	meta.FormatVersion = 8
+	AssertFatal(t, state.setMeta(nil, meta), "failed setting meta")
+	state.Close()
+
+	state, err = NewState(1, opts)
+	AssertFatal(t, err, "failed migrating")
+	defer state.Close()
+
+	var raw *discordgo.Guild
+	_, err = state.GetKey(nil, KeyGuild("1"), &raw)
+	AssertFatal(t, err, "failed retrieving raw guild")
+	if raw.Roles != nil || raw.Emojis != nil || raw.Channels != nil {
+		t.Error("roles, emojis or channels left on the guild")
+	}
+
+	guild, err := state.Guild("1")
+	AssertFatal(t, err, "failed retrieving guild")
+	if len(guild.Roles) != 1 || len(guild.Emojis) != 1 || len(guild.Channels) != 1 {
+		t.Errorf("unexpected guild after migrating: %#v", guild)
+	}
+}
+
+func TestEmojisUpdate(t *testing.T) {
+	state, err := NewState(1, Options{Store: NewMemoryStore()})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{
+		ID:     "1",
+		Emojis: []*discordgo.Emoji{{ID: "200", Name: "kept"}, {ID: "201", Name: "old"}, {ID: "202", Name: "removed"}},
+	}}), "failed handling guild create")
+
+	result, err := state.HandleEventMutexSyncedResult(0, &discordgo.GuildEmojisUpdate{
+		GuildID: "1",
+		Emojis:  []*discordgo.Emoji{{ID: "200", Name: "kept"}, {ID: "201", Name: "new"}, {ID: "203", Name: "added"}},
+	})
+	AssertFatal(t, err, "failed handling emojis update")
+
+	change := result.EmojisChange()
+	if change == nil {
+		t.Fatal("no emojis change")
+	}
+	if len(change.Added) != 1 || change.Added[0].ID != "203" {
+		t.Errorf("unexpected added emojis: %#v", change.Added)
+	}
+	if len(change.Removed) != 1 || change.Removed[0].ID != "202" {
+		t.Errorf("unexpected removed emojis: %#v", change.Removed)
+	}
+	if len(change.Renamed) != 1 || change.Renamed[0].Name != "new" {
+		t.Errorf("unexpected renamed emojis: %#v", change.Renamed)
+	}
+
+	emoji, err := state.GuildEmoji("1", "201")
+	AssertFatal(t, err, "failed retrieving emoji")
+	if emoji.Name != "new" {
+		t.Errorf("emoji not renamed: %q", emoji.Name)
+	}
+	if _, err = state.GuildEmoji("1", "202"); err != ErrNotFound {
+		t.Error("removed emoji still in state: ", err)
+	}
+
+	var ids []string
+	err = state.IterateGuildEmojis(nil, "1", func(e *discordgo.Emoji) bool {
+		ids = append(ids, e.ID)
+		return true
+	})
+	AssertFatal(t, err, "failed iterating emojis")
+	if len(ids) != 3 || ids[0] != "200" || ids[1] != "201" || ids[2] != "203" {
+		t.Errorf("unexpected emojis: %v", ids)
+	}
+}
+
+func TestGuildChannelTypes(t *testing.T) {
+	state, err := NewState(1, Options{Store: NewMemoryStore(), TrackChannels: true, TrackMembers: true})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	events := []interface{}{
+		&discordgo.GuildCreate{Guild: &discordgo.Guild{
+			ID:       "1",
+			OwnerID:  "5",
+			Channels: []*discordgo.Channel{{ID: "10", Type: discordgo.ChannelTypeGuildText}},
+			Members:  []*discordgo.Member{{User: &discordgo.User{ID: "5"}}},
+		}},
+		&discordgo.ChannelCreate{Channel: &discordgo.Channel{ID: "11", GuildID: "1", Type: discordgo.ChannelTypeGuildVoice}},
+		&discordgo.ChannelCreate{Channel: &discordgo.Channel{ID: "12", GuildID: "1", Type: discordgo.ChannelTypeGuildCategory}},
+		&discordgo.ChannelCreate{Channel: &discordgo.Channel{ID: "13", GuildID: "1", Type: discordgo.ChannelTypeGuildNews}},
+		&discordgo.ChannelCreate{Channel: &discordgo.Channel{ID: "14", GuildID: "1", Type: discordgo.ChannelTypeGuildVoice}},
+		&discordgo.ChannelDelete{Channel: &discordgo.Channel{ID: "14", GuildID: "1"}},
+	}
+
+	for _, v := range events {
+		AssertFatal(t, state.HandleEventNoSync(0, v), "failed handling event")
+	}
+
+	g, err := state.Guild("1")
+	AssertFatal(t, err, "failed retrieving guild")
+	if len(g.Channels) != 4 {
+		t.Errorf("unexpected number of guild channels: %d", len(g.Channels))
+	}
+
+	_, err = state.MemberPermissions(g, "11", "5")
+	AssertFatal(t, err, "failed calculating permissions in a voice channel")
+
+	var ids []string
+	err = state.IterateGuildChannels(nil, "1", func(c *discordgo.Channel) bool {
+		ids = append(ids, c.ID)
+		return true
+	}, discordgo.ChannelTypeGuildVoice, discordgo.ChannelTypeGuildCategory)
+	AssertFatal(t, err, "failed iterating guild channels")
+	if len(ids) != 2 || ids[0] != "11" || ids[1] != "12" {
+		t.Errorf("unexpected guild channels: %v", ids)
+	}
+}
@@ -0,0 +1,409 @@
+package dbstate
+
+import (
+	"encoding/binary"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchGuildMembers returns up to limit members whose username or nickname starts with prefix (case insensitive)
+// sorted by the matched name, if limit <= 0 then all matching members are returned
+func (s *State) SearchGuildMembers(guildID, prefix string, limit int) ([]*discordgo.Member, error) {
+	return s.SearchGuildMembersWithTxn(nil, guildID, prefix, limit)
+}
+
+// SearchGuildMembersWithTxn is the same as SearchGuildMembers but allows you to pass a transaction
+func (s *State) SearchGuildMembersWithTxn(txn Txn, guildID, prefix string, limit int) (members []*discordgo.Member, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			members, err = s.SearchGuildMembersWithTxn(txn, guildID, prefix, limit)
+			return err
+		})
+		return
+	}
+
+	// Collect the user ids first, a member can be indexed under both the username and nickname
+	var userIDs []string
+	seen := make(map[uint64]bool)
+
+	iterPrefix := KeyMemberNameIteratorPrefix(guildID, strings.ToLower(prefix))
+
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(iterPrefix); it.ValidForPrefix(iterPrefix); it.Next() {
+		key := it.Item().Key()
+		if len(key) < len(iterPrefix)+9 {
+			continue
+		}
+
+		userID := binary.BigEndian.Uint64(key[len(key)-8:])
+		if seen[userID] {
+			continue
+		}
+
+		seen[userID] = true
+		userIDs = append(userIDs, strconv.FormatUint(userID, 10))
+		if limit > 0 && len(userIDs) >= limit {
+			break
+		}
+	}
+
+	members = make([]*discordgo.Member, 0, len(userIDs))
+	for _, v := range userIDs {
+		m, err := s.GuildMemberWithTxn(txn, guildID, v)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+
+			return nil, err
+		}
+
+		members = append(members, m)
+	}
+
+	return members, nil
+}
+
+// IterateRoleMembers iterates over all the members with the role, calling f on them
+// if f returns false then iteration will stop
+func (s *State) IterateRoleMembers(txn Txn, guildID, roleID string, f func(m *discordgo.Member) bool) error {
+	if txn == nil {
+		return s.Store.View(func(txn Txn) error {
+			return s.IterateRoleMembers(txn, guildID, roleID, f)
+		})
+	}
+
+	prefix := KeyRoleMembersIteratorPrefix(guildID, roleID)
+
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		userID := strconv.FormatUint(binary.BigEndian.Uint64(key[len(prefix):]), 10)
+
+		m, err := s.GuildMemberWithTxn(txn, guildID, userID)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+
+			return err
+		}
+
+		if !f(m) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// CountRoleMembers returns the number of members in state with the role
+func (s *State) CountRoleMembers(guildID, roleID string) (n int, err error) {
+	err = s.Store.View(func(txn Txn) error {
+		n = countKeysWithPrefix(txn, KeyRoleMembersIteratorPrefix(guildID, roleID))
+		return nil
+	})
+
+	return
+}
+
+// IterateVoiceChannelMembers iterates over the voice states of the users in the voice channel, calling f on them
+// if f returns false then iteration will stop
+func (s *State) IterateVoiceChannelMembers(txn Txn, channelID string, f func(vs *discordgo.VoiceState) bool) error {
+	if txn == nil {
+		return s.Store.View(func(txn Txn) error {
+			return s.IterateVoiceChannelMembers(txn, channelID, f)
+		})
+	}
+
+	prefix := KeyVoiceChannelMembersIteratorPrefix(channelID)
+
+	opts := DefaultIteratorOptions
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		key := item.Key()
+
+		// The value is the guild id
+		v, err := item.Value()
+		if err != nil {
+			return err
+		}
+
+		if len(v) != 8 {
+			continue
+		}
+
+		guildID := strconv.FormatUint(binary.BigEndian.Uint64(v), 10)
+		userID := strconv.FormatUint(binary.BigEndian.Uint64(key[len(prefix):]), 10)
+
+		vs, err := s.VoiceStateWithTxn(txn, guildID, userID)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+
+			return err
+		}
+
+		if !f(vs) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// VoiceChannelMemberCount returns the number of users in the voice channel
+func (s *State) VoiceChannelMemberCount(channelID string) (n int, err error) {
+	err = s.Store.View(func(txn Txn) error {
+		n = countKeysWithPrefix(txn, KeyVoiceChannelMembersIteratorPrefix(channelID))
+		return nil
+	})
+
+	return
+}
+
+// LastUserMessages returns the last n messages by the user in the guild newest first, if n <= 0 then it will return all messages
+// Messages deleted with KeepDeletedMessages enabled are included with the Deleted field set
+func (s *State) LastUserMessages(guildID, userID string, n int) ([]*MessageWithMeta, error) {
+	return s.LastUserMessagesWithTxn(nil, guildID, userID, n)
+}
+
+// LastUserMessagesWithTxn is the same as LastUserMessages but allows you to pass a transaction
+func (s *State) LastUserMessagesWithTxn(txn Txn, guildID, userID string, n int) (messages []*MessageWithMeta, err error) {
+	return s.lastUserMessages(txn, KeyGuildUserMessagesIteratorPrefix(guildID, userID), "", n)
+}
+
+// LastUserMessagesInChannel returns the last n messages by the user in the channel newest first, if n <= 0 then it will return all messages
+// Messages deleted with KeepDeletedMessages enabled are included with the Deleted field set
+func (s *State) LastUserMessagesInChannel(channelID, userID string, n int) ([]*MessageWithMeta, error) {
+	return s.LastUserMessagesInChannelWithTxn(nil, channelID, userID, n)
+}
+
+// LastUserMessagesInChannelWithTxn is the same as LastUserMessagesInChannel but allows you to pass a transaction
+func (s *State) LastUserMessagesInChannelWithTxn(txn Txn, channelID, userID string, n int) (messages []*MessageWithMeta, err error) {
+	return s.lastUserMessages(txn, KeyChannelUserMessagesIteratorPrefix(channelID, userID), channelID, n)
+}
+
+// lastUserMessages returns the messages in the author index under prefix
+// if channelID is empty then the channel id is taken from the values in the index
+func (s *State) lastUserMessages(txn Txn, prefix []byte, channelID string, n int) (messages []*MessageWithMeta, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			messages, err = s.lastUserMessages(txn, prefix, channelID, n)
+			return err
+		})
+		return
+	}
+
+	// Seek to the last possible message
+	seek := make([]byte, len(prefix)+8)
+	copy(seek, prefix)
+	for i := len(prefix); i < len(seek); i++ {
+		seek[i] = 0xff
+	}
+
+	opts := DefaultIteratorOptions
+	opts.Reverse = true
+	it := txn.NewIterator(opts)
+	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		messageID := strconv.FormatUint(binary.BigEndian.Uint64(key[len(prefix):]), 10)
+
+		msgChannelID := channelID
+		if msgChannelID == "" {
+			// The value is the channel id
+			v, err := item.Value()
+			if err != nil {
+				return nil, err
+			}
+
+			if len(v) != 8 {
+				continue
+			}
+
+			msgChannelID = strconv.FormatUint(binary.BigEndian.Uint64(v), 10)
+		}
+
+		m, flags, err := s.ChannelMessageWithTxn(txn, msgChannelID, messageID)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+
+			return nil, err
+		}
+
+		messages = append(messages, &MessageWithMeta{
+			Message:     m,
+			Deleted:     flags&MessageFlagDeleted != 0,
+			BulkDeleted: flags&MessageFlagBulkDeleted != 0,
+		})
+
+		if n > 0 && len(messages) >= n {
+			break
+		}
+	}
+
+	return messages, nil
+}
+
+// memberIndexNames returns the lowercased names a member is indexed under in the member name index
+func memberIndexNames(m *discordgo.Member) []string {
+	names := make([]string, 0, 2)
+	if m.User != nil && m.User.Username != "" {
+		names = append(names, strings.ToLower(m.User.Username))
+	}
+
+	if m.Nick != "" {
+		nick := strings.ToLower(m.Nick)
+		if len(names) < 1 || names[0] != nick {
+			names = append(names, nick)
+		}
+	}
+
+	return names
+}
+
+// updateMemberIndexes updates the indexes of a member, old is nil if the member was added and new is nil if it was removed
+func (w *shardWorker) updateMemberIndexes(txn Txn, guildID, userID string, old, new *discordgo.Member) error {
+	var oldNames, newNames []string
+	if old != nil {
+		oldNames = memberIndexNames(old)
+	}
+	if new != nil {
+		newNames = memberIndexNames(new)
+	}
+
+	for _, v := range oldNames {
+		if !containsStr(newNames, v) {
+			err := txn.Delete(KeyMemberName(guildID, v, userID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, v := range newNames {
+		if !containsStr(oldNames, v) {
+			err := txn.Set(KeyMemberName(guildID, v, userID), []byte{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var oldRoles, newRoles []string
+	if old != nil {
+		oldRoles = old.Roles
+	}
+	if new != nil {
+		newRoles = new.Roles
+	}
+
+	for _, v := range oldRoles {
+		if !containsStr(newRoles, v) {
+			err := txn.Delete(KeyRoleMember(guildID, v, userID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, v := range newRoles {
+		if !containsStr(oldRoles, v) {
+			err := txn.Set(KeyRoleMember(guildID, v, userID), []byte{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func containsStr(strs []string, str string) bool {
+	for _, v := range strs {
+		if v == str {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateVoiceStateIndexes updates the voice channel index, old is nil if the user was not in a voice channel
+// and the user left the voice channel if new.ChannelID is empty
+func (w *shardWorker) updateVoiceStateIndexes(txn Txn, old, new *discordgo.VoiceState) error {
+	if old != nil && old.ChannelID == new.ChannelID {
+		return nil
+	}
+
+	if old != nil && old.ChannelID != "" {
+		err := txn.Delete(KeyVoiceChannelMember(old.ChannelID, old.UserID))
+		if err != nil {
+			return err
+		}
+	}
+
+	if new.ChannelID == "" {
+		return nil
+	}
+
+	return txn.Set(KeyVoiceChannelMember(new.ChannelID, new.UserID), idValue(new.GuildID))
+}
+
+// setMessageIndexes sets the author index entries of a message, using the same ttl as the message
+func (w *shardWorker) setMessageIndexes(txn Txn, guildID string, msg *discordgo.Message) error {
+	if msg.Author == nil {
+		return nil
+	}
+
+	ttl := w.State.opts.MessageTTL
+
+	err := setWithTTL(txn, KeyChannelUserMessage(msg.ChannelID, msg.Author.ID, msg.ID), []byte{}, ttl)
+	if err != nil || guildID == "" {
+		return err
+	}
+
+	return setWithTTL(txn, KeyGuildUserMessage(guildID, msg.Author.ID, msg.ID), idValue(msg.ChannelID), ttl)
+}
+
+// deleteMessageIndexes deletes the author index entries of a message
+func (w *shardWorker) deleteMessageIndexes(txn Txn, guildID string, msg *discordgo.Message) error {
+	if msg.Author == nil {
+		return nil
+	}
+
+	err := txn.Delete(KeyChannelUserMessage(msg.ChannelID, msg.Author.ID, msg.ID))
+	if err != nil || guildID == "" {
+		return err
+	}
+
+	return txn.Delete(KeyGuildUserMessage(guildID, msg.Author.ID, msg.ID))
+}
+
+func setWithTTL(txn Txn, key, value []byte, ttl time.Duration) error {
+	if ttl > 0 {
+		return txn.SetWithTTL(key, value, ttl)
+	}
+
+	return txn.Set(key, value)
+}
+
+// idValue returns id encoded as a big endian uint64, used as the value of index entries pointing to another object
+func idValue(id string) []byte {
+	parsed, _ := strconv.ParseUint(id, 10, 64)
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, parsed)
+	return buf
+}
@@ -0,0 +1,267 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSearchGuildMembers(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:        NewMemoryStore(),
+		TrackMembers: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	w := state.shards[0]
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "10", Username: "Alice"}, Nick: "Wonderland"}), "failed adding member")
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "11", Username: "alfred"}}), "failed adding member")
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "12", Username: "bob"}, Nick: "albert"}), "failed adding member")
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "2", User: &discordgo.User{ID: "13", Username: "alan"}}), "failed adding member")
+
+	assertSearch := func(prefix string, limit int, expected ...string) {
+		members, err := state.SearchGuildMembers("1", prefix, limit)
+		AssertFatal(t, err, "failed searching members")
+
+		if len(members) != len(expected) {
+			t.Fatalf("unexpected number of results searching for %q: %d", prefix, len(members))
+		}
+
+		for i, v := range members {
+			if v.User.ID != expected[i] {
+				t.Errorf("unexpected result %d searching for %q: %s, expected %s", i, prefix, v.User.ID, expected[i])
+			}
+		}
+	}
+
+	assertSearch("AL", 0, "12", "11", "10")
+	assertSearch("al", 2, "12", "11")
+	assertSearch("won", 0, "10")
+	assertSearch("x", 0)
+
+	// Nickname changed
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "12", Username: "bob"}}), "failed updating member")
+	assertSearch("al", 0, "11", "10")
+	assertSearch("bo", 0, "12")
+
+	AssertFatal(t, w.MemberRemove(nil, "1", "10", false), "failed removing member")
+	assertSearch("al", 0, "11")
+	assertSearch("won", 0)
+}
+
+func TestRoleMembers(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:        NewMemoryStore(),
+		TrackMembers: true,
+		TrackRoles:   true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	w := state.shards[0]
+	AssertFatal(t, w.GuildCreate(&discordgo.Guild{ID: "1", Roles: []*discordgo.Role{{ID: "100"}, {ID: "200"}}}), "failed creating guild")
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "10"}, Roles: []string{"100", "200"}}), "failed adding member")
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "11"}, Roles: []string{"100"}}), "failed adding member")
+
+	assertRoleMembers := func(roleID string, expected ...string) {
+		var members []string
+		err := state.IterateRoleMembers(nil, "1", roleID, func(m *discordgo.Member) bool {
+			members = append(members, m.User.ID)
+			return true
+		})
+		AssertFatal(t, err, "failed iterating role members")
+
+		n, err := state.CountRoleMembers("1", roleID)
+		AssertFatal(t, err, "failed counting role members")
+
+		if len(members) != len(expected) || n != len(expected) {
+			t.Fatalf("unexpected number of members with role %s: %d, counted %d, expected %d", roleID, len(members), n, len(expected))
+		}
+
+		for i, v := range members {
+			if v != expected[i] {
+				t.Errorf("unexpected member with role %s: %s, expected %s", roleID, v, expected[i])
+			}
+		}
+	}
+
+	assertRoleMembers("100", "10", "11")
+	assertRoleMembers("200", "10")
+
+	AssertFatal(t, w.MemberUpdate(nil, &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "11"}, Roles: []string{"200"}}), "failed updating member")
+	assertRoleMembers("100", "10")
+	assertRoleMembers("200", "10", "11")
+
+	AssertFatal(t, w.MemberRemove(nil, "1", "10", false), "failed removing member")
+	assertRoleMembers("100")
+	assertRoleMembers("200", "11")
+
+	AssertFatal(t, w.RoleDelete(nil, "1", "200"), "failed deleting role")
+	assertRoleMembers("200")
+}
+
+func TestVoiceChannelMembers(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store: NewMemoryStore(),
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	w := state.shards[0]
+	AssertFatal(t, w.GuildCreate(&discordgo.Guild{ID: "1", VoiceStates: []*discordgo.VoiceState{{UserID: "10", ChannelID: "100"}}}), "failed creating guild")
+	AssertFatal(t, w.VoiceStateUpdate(nil, &discordgo.VoiceState{GuildID: "1", UserID: "11", ChannelID: "100"}), "failed updating voice state")
+
+	assertVoiceChannel := func(channelID string, expected ...string) {
+		var users []string
+		err := state.IterateVoiceChannelMembers(nil, channelID, func(vs *discordgo.VoiceState) bool {
+			users = append(users, vs.UserID)
+			return true
+		})
+		AssertFatal(t, err, "failed iterating voice channel members")
+
+		n, err := state.VoiceChannelMemberCount(channelID)
+		AssertFatal(t, err, "failed counting voice channel members")
+
+		if len(users) != len(expected) || n != len(expected) {
+			t.Fatalf("unexpected number of users in voice channel %s: %d, counted %d, expected %d", channelID, len(users), n, len(expected))
+		}
+
+		for i, v := range users {
+			if v != expected[i] {
+				t.Errorf("unexpected user in voice channel %s: %s, expected %s", channelID, v, expected[i])
+			}
+		}
+	}
+
+	assertVoiceChannel("100", "10", "11")
+
+	// Moved
+	AssertFatal(t, w.VoiceStateUpdate(nil, &discordgo.VoiceState{GuildID: "1", UserID: "10", ChannelID: "200"}), "failed updating voice state")
+	assertVoiceChannel("100", "11")
+	assertVoiceChannel("200", "10")
+
+	// Left
+	AssertFatal(t, w.VoiceStateUpdate(nil, &discordgo.VoiceState{GuildID: "1", UserID: "11"}), "failed updating voice state")
+	assertVoiceChannel("100")
+	assertVoiceChannel("200", "10")
+}
+
+func TestLastUserMessages(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:         NewMemoryStore(),
+		TrackMessages: true,
+		MessageTTL:    time.Hour,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	w := state.shards[0]
+	create := func(channelID, messageID, userID string) {
+		m := &discordgo.Message{ID: messageID, ChannelID: channelID, GuildID: "1", Author: &discordgo.User{ID: userID}}
+		AssertFatal(t, w.MessageCreateUpdate(nil, m), "failed creating message")
+	}
+
+	create("100", "1", "10")
+	create("200", "2", "10")
+	create("100", "3", "11")
+	create("100", "4", "10")
+
+	assertMessages := func(messages []*MessageWithMeta, err error, expected ...string) {
+		AssertFatal(t, err, "failed retrieving user messages")
+
+		if len(messages) != len(expected) {
+			t.Fatalf("unexpected number of messages: %d, expected %d", len(messages), len(expected))
+		}
+
+		for i, v := range messages {
+			if v.ID != expected[i] {
+				t.Errorf("unexpected message %d: %s, expected %s", i, v.ID, expected[i])
+			}
+		}
+	}
+
+	messages, err := state.LastUserMessages("1", "10", 0)
+	assertMessages(messages, err, "4", "2", "1")
+	messages, err = state.LastUserMessages("1", "10", 2)
+	assertMessages(messages, err, "4", "2")
+	messages, err = state.LastUserMessagesInChannel("100", "10", 0)
+	assertMessages(messages, err, "4", "1")
+
+	AssertFatal(t, w.MessageDelete(nil, "100", "4"), "failed deleting message")
+	messages, err = state.LastUserMessagesInChannel("100", "10", 0)
+	assertMessages(messages, err, "1")
+
+	// The index entries should expire with the message
+	AssertFatal(t, state.Store.View(func(txn Txn) error {
+		item, err := txn.Get(KeyGuildUserMessage("1", "10", "1"))
+		if err == nil && item.ExpiresAt() == 0 {
+			t.Error("no ttl set on the author index entry")
+		}
+		return err
+	}), "failed retrieving index entry")
+}
+
+func TestMigrateV4MemberNameIndex(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_migrate_v4")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	opts := Options{DBOpts: RecommendedBadgerOptions(dir), KeepStateOnStart: true, TrackMembers: true}
+	state, err := NewState(1, opts)
+	AssertFatal(t, err, "failed creating state")
+
+	// Add a member without the index
+	err = state.SetKey(nil, nil, nil, KeyGuildMember("1", "10"), &discordgo.Member{GuildID: "1", User: &discordgo.User{ID: "10", Username: "alice"}})
+	AssertFatal(t, err, "failed setting member")
+
+	meta, err := state.getMeta(nil)
+	AssertFatal(t, err, "failed retrieving meta")
+	meta.FormatVersion = 4
+	AssertFatal(t, state.setMeta(nil, meta), "failed setting meta")
+	state.Close()
+
+	state, err = NewState(1, opts)
+	AssertFatal(t, err, "failed migrating")
+	defer state.Close()
+
+	members, err := state.SearchGuildMembers("1", "ali", 0)
+	AssertFatal(t, err, "failed searching members")
+	if len(members) != 1 || members[0].User.ID != "10" {
+		t.Errorf("unexpected search results after migrating: %d", len(members))
+	}
+}
+
+func TestMigrateV7MessageAuthorIndex(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_migrate_v7")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	opts := Options{DBOpts: RecommendedBadgerOptions(dir), KeepStateOnStart: true, TrackMessages: true}
+	state, err := NewState(1, opts)
+	AssertFatal(t, err, "failed creating state")
+
+	// A message without a guild id, the guild has to be resolved from the channel
+	err = state.SetKey(nil, nil, nil, KeyChannel("10"), &discordgo.Channel{ID: "10", GuildID: "1"})
+	AssertFatal(t, err, "failed setting channel")
+	err = state.SetKey(nil, nil, nil, KeyChannelMessage("10", "50"), &discordgo.Message{ID: "50", ChannelID: "10", Author: &discordgo.User{ID: "5"}})
+	AssertFatal(t, err, "failed setting message")
+
+	meta, err := state.getMeta(nil)
+	AssertFatal(t, err, "failed retrieving meta")
+	meta.FormatVersion = 7
+	AssertFatal(t, state.setMeta(nil, meta), "failed setting meta")
+	state.Close()
+
+	state, err = NewState(1, opts)
+	AssertFatal(t, err, "failed migrating")
+	defer state.Close()
+
+	messages, err := state.LastUserMessages("1", "5", 0)
+	AssertFatal(t, err, "failed retrieving user messages")
+	if len(messages) != 1 || messages[0].ID != "50" {
+		t.Errorf("unexpected user messages after migrating: %d", len(messages))
+	}
+}
@@ -1,163 +1,369 @@
 package dbstate
 
 import (
+	"bytes"
 	"github.com/bwmarrin/discordgo"
-	"github.com/dgraph-io/badger"
 )
 
 // IterateGuilds Iterates over all *discordgo.Guild in state, calling f on them
 // if f returns false then iteration will stop
-func (s *State) IterateGuilds(txn *badger.Txn, f func(d *discordgo.Guild) bool) error {
+func (s *State) IterateGuilds(txn Txn, f func(d *discordgo.Guild) bool) error {
+	_, err := s.IterateGuildsPage(txn, nil, 0, f)
+	return err
+}
+
+// IterateGuildsPage is the same as IterateGuilds but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IterateGuildsPage(txn Txn, cursor Cursor, limit int, f func(d *discordgo.Guild) bool) (next Cursor, err error) {
 	if txn == nil {
-		return s.DB.View(func(txn *badger.Txn) error {
-			return s.IterateGuilds(txn, f)
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IterateGuildsPage(txn, cursor, limit, f)
+			return err
 		})
+		return
 	}
 
 	// Scan over the prefix
 	prefix := []byte{byte(KeyTypeGuild)}
 	seek := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
 
-	opts := badger.DefaultIteratorOptions
+	opts := DefaultIteratorOptions
 	it := txn.NewIterator(opts)
-	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		v, err := item.Value()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var dest *discordgo.Guild
 		err = s.DecodeData(v, &dest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
+		err = s.fillGuild(txn, dest)
+		if err != nil {
+			return nil, err
+		}
+		n++
+
 		// Call the callback
-		if !f(dest) {
+		if !f(dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
 			break
 		}
 	}
-	return nil
+	return next, nil
+}
+
+// CountGuilds returns the number of *discordgo.Guild IterateGuilds would iterate over, without retrieving or decoding the values
+func (s *State) CountGuilds() (int, error) {
+	return s.CountGuildsWithTxn(nil)
+}
+
+// CountGuildsWithTxn is the same as CountGuilds but allows you to pass a transaction
+func (s *State) CountGuildsWithTxn(txn Txn) (n int, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			n, err = s.CountGuildsWithTxn(txn)
+			return err
+		})
+		return
+	}
+
+	return countKeysWithPrefix(txn, []byte{byte(KeyTypeGuild)}), nil
 }
 
 // IteratePresences Iterates over all *discordgo.Presence in state, calling f on them
 // if f returns false then iteration will stop
-func (s *State) IteratePresences(txn *badger.Txn, f func(d *discordgo.Presence) bool) error {
+func (s *State) IteratePresences(txn Txn, f func(d *discordgo.Presence) bool) error {
+	_, err := s.IteratePresencesPage(txn, nil, 0, f)
+	return err
+}
+
+// IteratePresencesPage is the same as IteratePresences but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IteratePresencesPage(txn Txn, cursor Cursor, limit int, f func(d *discordgo.Presence) bool) (next Cursor, err error) {
 	if txn == nil {
-		return s.DB.View(func(txn *badger.Txn) error {
-			return s.IteratePresences(txn, f)
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IteratePresencesPage(txn, cursor, limit, f)
+			return err
 		})
+		return
 	}
 
 	// Scan over the prefix
 	prefix := []byte{byte(KeyTypePresence)}
 	seek := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
 
-	opts := badger.DefaultIteratorOptions
+	opts := DefaultIteratorOptions
 	it := txn.NewIterator(opts)
-	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		v, err := item.Value()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var dest *discordgo.Presence
 		err = s.DecodeData(v, &dest)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		n++
 
 		// Call the callback
-		if !f(dest) {
+		if !f(dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
 			break
 		}
 	}
-	return nil
+	return next, nil
+}
+
+// CountPresences returns the number of *discordgo.Presence IteratePresences would iterate over, without retrieving or decoding the values
+func (s *State) CountPresences() (int, error) {
+	return s.CountPresencesWithTxn(nil)
+}
+
+// CountPresencesWithTxn is the same as CountPresences but allows you to pass a transaction
+func (s *State) CountPresencesWithTxn(txn Txn) (n int, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			n, err = s.CountPresencesWithTxn(txn)
+			return err
+		})
+		return
+	}
+
+	return countKeysWithPrefix(txn, []byte{byte(KeyTypePresence)}), nil
 }
 
 // IterateGuildMembers Iterates over all *discordgo.Member in state, calling f on them
 // if f returns false then iteration will stop
-func (s *State) IterateGuildMembers(txn *badger.Txn, guildID string, f func(d *discordgo.Member) bool) error {
+func (s *State) IterateGuildMembers(txn Txn, guildID string, f func(d *discordgo.Member) bool) error {
+	_, err := s.IterateGuildMembersPage(txn, guildID, nil, 0, f)
+	return err
+}
+
+// IterateGuildMembersPage is the same as IterateGuildMembers but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IterateGuildMembersPage(txn Txn, guildID string, cursor Cursor, limit int, f func(d *discordgo.Member) bool) (next Cursor, err error) {
 	if txn == nil {
-		return s.DB.View(func(txn *badger.Txn) error {
-			return s.IterateGuildMembers(txn, guildID, f)
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IterateGuildMembersPage(txn, guildID, cursor, limit, f)
+			return err
 		})
+		return
 	}
 
 	// Scan over the prefix
 	prefix := KeyGuildMembersIteratorPrefix(guildID)
 	seek := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
 
-	opts := badger.DefaultIteratorOptions
+	opts := DefaultIteratorOptions
 	it := txn.NewIterator(opts)
-	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		v, err := item.Value()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var dest *discordgo.Member
 		err = s.DecodeData(v, &dest)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		n++
 
 		// Call the callback
-		if !f(dest) {
+		if !f(dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
 			break
 		}
 	}
-	return nil
+	return next, nil
+}
+
+// CountGuildMembers returns the number of *discordgo.Member IterateGuildMembers would iterate over, without retrieving or decoding the values
+func (s *State) CountGuildMembers(guildID string) (int, error) {
+	return s.CountGuildMembersWithTxn(nil, guildID)
+}
+
+// CountGuildMembersWithTxn is the same as CountGuildMembers but allows you to pass a transaction
+func (s *State) CountGuildMembersWithTxn(txn Txn, guildID string) (n int, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			n, err = s.CountGuildMembersWithTxn(txn, guildID)
+			return err
+		})
+		return
+	}
+
+	return countKeysWithPrefix(txn, KeyGuildMembersIteratorPrefix(guildID)), nil
 }
 
 // IterateChannelMessages Iterates over all *discordgo.Message in state, calling f on them
 // if f returns false then iteration will stop
-func (s *State) IterateChannelMessages(txn *badger.Txn, channelID string, f func(m MessageFlag, d *discordgo.Message) bool) error {
+func (s *State) IterateChannelMessages(txn Txn, channelID string, f func(m MessageFlag, d *discordgo.Message) bool) error {
+	_, err := s.IterateChannelMessagesPage(txn, channelID, nil, 0, f)
+	return err
+}
+
+// IterateChannelMessagesPage is the same as IterateChannelMessages but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IterateChannelMessagesPage(txn Txn, channelID string, cursor Cursor, limit int, f func(m MessageFlag, d *discordgo.Message) bool) (next Cursor, err error) {
 	if txn == nil {
-		return s.DB.View(func(txn *badger.Txn) error {
-			return s.IterateChannelMessages(txn, channelID, f)
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IterateChannelMessagesPage(txn, channelID, cursor, limit, f)
+			return err
 		})
+		return
 	}
 
 	// Scan over the prefix
 	prefix := KeyChannelMessageIteratorPrefix(channelID)
 	seek := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
 
-	opts := badger.DefaultIteratorOptions
+	opts := DefaultIteratorOptions
 	it := txn.NewIterator(opts)
-	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		v, err := item.Value()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var dest *discordgo.Message
 		err = s.DecodeData(v, &dest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		meta := MessageFlag(item.UserMeta())
+		n++
 
 		// Call the callback
-		if !f(meta, dest) {
+		if !f(meta, dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
 			break
 		}
 	}
-	return nil
+	return next, nil
+}
+
+// CountChannelMessages returns the number of *discordgo.Message IterateChannelMessages would iterate over, without retrieving or decoding the values
+func (s *State) CountChannelMessages(channelID string) (int, error) {
+	return s.CountChannelMessagesWithTxn(nil, channelID)
+}
+
+// CountChannelMessagesWithTxn is the same as CountChannelMessages but allows you to pass a transaction
+func (s *State) CountChannelMessagesWithTxn(txn Txn, channelID string) (n int, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			n, err = s.CountChannelMessagesWithTxn(txn, channelID)
+			return err
+		})
+		return
+	}
+
+	return countKeysWithPrefix(txn, KeyChannelMessageIteratorPrefix(channelID)), nil
 }
 
 // IterateChannelMessagesNewerFirst Iterates over all *discordgo.Message in state, calling f on them
 // if f returns false then iteration will stop
-func (s *State) IterateChannelMessagesNewerFirst(txn *badger.Txn, channelID string, f func(m MessageFlag, d *discordgo.Message) bool) error {
+func (s *State) IterateChannelMessagesNewerFirst(txn Txn, channelID string, f func(m MessageFlag, d *discordgo.Message) bool) error {
+	_, err := s.IterateChannelMessagesNewerFirstPage(txn, channelID, nil, 0, f)
+	return err
+}
+
+// IterateChannelMessagesNewerFirstPage is the same as IterateChannelMessagesNewerFirst but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IterateChannelMessagesNewerFirstPage(txn Txn, channelID string, cursor Cursor, limit int, f func(m MessageFlag, d *discordgo.Message) bool) (next Cursor, err error) {
 	if txn == nil {
-		return s.DB.View(func(txn *badger.Txn) error {
-			return s.IterateChannelMessagesNewerFirst(txn, channelID, f)
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IterateChannelMessagesNewerFirstPage(txn, channelID, cursor, limit, f)
+			return err
 		})
+		return
 	}
 
 	// Scan over the prefix
@@ -174,104 +380,317 @@ func (s *State) IterateChannelMessagesNewerFirst(txn *badger.Txn, channelID stri
 	seek[14] = 0xff
 	seek[15] = 0xff
 	seek[16] = 0xff
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
 
-	opts := badger.DefaultIteratorOptions
+	opts := DefaultIteratorOptions
 	opts.Reverse = true
 
 	it := txn.NewIterator(opts)
-	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		v, err := item.Value()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var dest *discordgo.Message
 		err = s.DecodeData(v, &dest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		meta := MessageFlag(item.UserMeta())
+		n++
 
 		// Call the callback
-		if !f(meta, dest) {
+		if !f(meta, dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
 			break
 		}
 	}
-	return nil
+	return next, nil
 }
 
 // IterateAllMessages Iterates over all *discordgo.Message in state, calling f on them
 // if f returns false then iteration will stop
-func (s *State) IterateAllMessages(txn *badger.Txn, f func(m MessageFlag, d *discordgo.Message) bool) error {
+func (s *State) IterateAllMessages(txn Txn, f func(m MessageFlag, d *discordgo.Message) bool) error {
+	_, err := s.IterateAllMessagesPage(txn, nil, 0, f)
+	return err
+}
+
+// IterateAllMessagesPage is the same as IterateAllMessages but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IterateAllMessagesPage(txn Txn, cursor Cursor, limit int, f func(m MessageFlag, d *discordgo.Message) bool) (next Cursor, err error) {
 	if txn == nil {
-		return s.DB.View(func(txn *badger.Txn) error {
-			return s.IterateAllMessages(txn, f)
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IterateAllMessagesPage(txn, cursor, limit, f)
+			return err
 		})
+		return
 	}
 
 	// Scan over the prefix
 	prefix := []byte{byte(KeyTypeChannelMessage)}
 	seek := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
 
-	opts := badger.DefaultIteratorOptions
+	opts := DefaultIteratorOptions
 	it := txn.NewIterator(opts)
-	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		v, err := item.Value()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var dest *discordgo.Message
 		err = s.DecodeData(v, &dest)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		meta := MessageFlag(item.UserMeta())
+		n++
 
 		// Call the callback
-		if !f(meta, dest) {
+		if !f(meta, dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
 			break
 		}
 	}
-	return nil
+	return next, nil
 }
 
 // IterateGuildVoiceStates Iterates over all *discordgo.VoiceState in state, calling f on them
 // if f returns false then iteration will stop
-func (s *State) IterateGuildVoiceStates(txn *badger.Txn, guildID string, f func(d *discordgo.VoiceState) bool) error {
+func (s *State) IterateGuildVoiceStates(txn Txn, guildID string, f func(d *discordgo.VoiceState) bool) error {
+	_, err := s.IterateGuildVoiceStatesPage(txn, guildID, nil, 0, f)
+	return err
+}
+
+// IterateGuildVoiceStatesPage is the same as IterateGuildVoiceStates but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IterateGuildVoiceStatesPage(txn Txn, guildID string, cursor Cursor, limit int, f func(d *discordgo.VoiceState) bool) (next Cursor, err error) {
 	if txn == nil {
-		return s.DB.View(func(txn *badger.Txn) error {
-			return s.IterateGuildVoiceStates(txn, guildID, f)
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IterateGuildVoiceStatesPage(txn, guildID, cursor, limit, f)
+			return err
 		})
+		return
 	}
 
 	// Scan over the prefix
 	prefix := KeyVoiceStateIteratorPrefix(guildID)
 	seek := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
 
-	opts := badger.DefaultIteratorOptions
+	opts := DefaultIteratorOptions
 	it := txn.NewIterator(opts)
-	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
 		item := it.Item()
 		v, err := item.Value()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var dest *discordgo.VoiceState
 		err = s.DecodeData(v, &dest)
 		if err != nil {
+			return nil, err
+		}
+		n++
+
+		// Call the callback
+		if !f(dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
+			break
+		}
+	}
+	return next, nil
+}
+
+// IterateGuildRoles Iterates over all *discordgo.Role in state, calling f on them
+// if f returns false then iteration will stop
+func (s *State) IterateGuildRoles(txn Txn, guildID string, f func(d *discordgo.Role) bool) error {
+	_, err := s.IterateGuildRolesPage(txn, guildID, nil, 0, f)
+	return err
+}
+
+// IterateGuildRolesPage is the same as IterateGuildRoles but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IterateGuildRolesPage(txn Txn, guildID string, cursor Cursor, limit int, f func(d *discordgo.Role) bool) (next Cursor, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IterateGuildRolesPage(txn, guildID, cursor, limit, f)
 			return err
+		})
+		return
+	}
+
+	// Scan over the prefix
+	prefix := KeyGuildRolesIteratorPrefix(guildID)
+	seek := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
+
+	opts := DefaultIteratorOptions
+	it := txn.NewIterator(opts)
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		v, err := item.Value()
+		if err != nil {
+			return nil, err
+		}
+
+		var dest *discordgo.Role
+		err = s.DecodeData(v, &dest)
+		if err != nil {
+			return nil, err
+		}
+		n++
+
+		// Call the callback
+		if !f(dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
+			break
+		}
+	}
+	return next, nil
+}
+
+// IterateGuildEmojis Iterates over all *discordgo.Emoji in state, calling f on them
+// if f returns false then iteration will stop
+func (s *State) IterateGuildEmojis(txn Txn, guildID string, f func(d *discordgo.Emoji) bool) error {
+	_, err := s.IterateGuildEmojisPage(txn, guildID, nil, 0, f)
+	return err
+}
+
+// IterateGuildEmojisPage is the same as IterateGuildEmojis but starts after cursor, and stops after limit items if limit > 0
+// The returned cursor continues after the last item passed to f, it's nil if there's nothing more to iterate over
+func (s *State) IterateGuildEmojisPage(txn Txn, guildID string, cursor Cursor, limit int, f func(d *discordgo.Emoji) bool) (next Cursor, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			next, err = s.IterateGuildEmojisPage(txn, guildID, cursor, limit, f)
+			return err
+		})
+		return
+	}
+
+	// Scan over the prefix
+	prefix := KeyGuildEmojisIteratorPrefix(guildID)
+	seek := prefix
+	if cursor != nil {
+		if !bytes.HasPrefix(cursor, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		seek = cursor
+	}
+
+	opts := DefaultIteratorOptions
+	it := txn.NewIterator(opts)
+	it.Seek(seek)
+	if cursor != nil && it.ValidForPrefix(prefix) && bytes.Equal(it.Item().Key(), cursor) {
+		// Continue after the last item of the previous page
+		it.Next()
+	}
+
+	n := 0
+	for ; it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		v, err := item.Value()
+		if err != nil {
+			return nil, err
+		}
+
+		var dest *discordgo.Emoji
+		err = s.DecodeData(v, &dest)
+		if err != nil {
+			return nil, err
 		}
+		n++
 
 		// Call the callback
-		if !f(dest) {
+		if !f(dest) || (limit > 0 && n >= limit) {
+			next = newCursor(item.Key())
+
+			// Only return a cursor if there's more
+			it.Next()
+			if !it.ValidForPrefix(prefix) {
+				next = nil
+			}
 			break
 		}
 	}
-	return nil
+	return next, nil
 }
@@ -15,15 +15,61 @@ var (
 )
 
 const (
-	KeyTypeGuild          KeyType = 'g'
-	KeyTypeMember         KeyType = 'f'
-	KeyTypeChannel        KeyType = 'c'
-	KeyTypeChannelMessage KeyType = 'm'
-	KeyTypePresence       KeyType = 'p'
-	KeyTypeVoiceState     KeyType = 'v'
-	KeyTypeLastMessage    KeyType = 'l'
+	KeyTypeGuild              KeyType = 'g'
+	KeyTypeMember             KeyType = 'f'
+	KeyTypeChannel            KeyType = 'c'
+	KeyTypeChannelMessage     KeyType = 'm'
+	KeyTypePresence           KeyType = 'p'
+	KeyTypeVoiceState         KeyType = 'v'
+	KeyTypeLastMessage        KeyType = 'l'
+	KeyTypeShardSession       KeyType = 's'
+	KeyTypeMemberLoadProgress KeyType = 'n'
+	KeyTypeMessageReaction    KeyType = 'r'
+	KeyTypeMemberName         KeyType = 'u'
+	KeyTypeRoleMember         KeyType = 'e'
+	KeyTypeVoiceChannelMember KeyType = 'j'
+	KeyTypeGuildUserMessage   KeyType = 'a'
+	KeyTypeChannelUserMessage KeyType = 'b'
+	KeyTypeGuildUnavailable   KeyType = 'k'
+	KeyTypeGuildRole          KeyType = 'd'
+	KeyTypeGuildEmoji         KeyType = 'h'
+	KeyTypeGuildChannel       KeyType = 'i'
+	KeyTypeDMChannel          KeyType = 'w'
+	KeyTypeUserDMChannel      KeyType = 'x'
 )
 
+// messageKeyTypes are the key types of messages and the data belonging to them, these are kept with Options.KeepOldMessagesOnStart
+var messageKeyTypes = []KeyType{KeyTypeChannelMessage, KeyTypeMessageReaction, KeyTypeGuildUserMessage, KeyTypeChannelUserMessage}
+
+func isMessageKeyType(t KeyType) bool {
+	for _, v := range messageKeyTypes {
+		if v == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// guildKeyTypes are the key types prefixed by a guild id
+var guildKeyTypes = []KeyType{KeyTypeMember, KeyTypeVoiceState, KeyTypeMemberLoadProgress, KeyTypeMemberName, KeyTypeRoleMember, KeyTypeGuildUserMessage, KeyTypeGuildUnavailable,
+	KeyTypeGuildRole, KeyTypeGuildEmoji, KeyTypeGuildChannel}
+
+// channelKeyTypes are the key types prefixed by a channel id
+var channelKeyTypes = []KeyType{KeyTypeChannelMessage, KeyTypeMessageReaction, KeyTypeVoiceChannelMember, KeyTypeChannelUserMessage}
+
+// KeyIDPrefix returns the prefix of the keys of type t prefixed by id
+func KeyIDPrefix(t KeyType, id string) []byte {
+	// 1 keytype, 8 id
+	buf := make([]byte, 9)
+	buf[0] = byte(t)
+
+	parsed, _ := strconv.ParseUint(id, 10, 64)
+	binary.BigEndian.PutUint64(buf[1:], parsed)
+
+	return buf
+}
+
 func KeyGuild(guildID string) []byte {
 
 	// 0 keytype, 8 id
@@ -133,3 +179,243 @@ func KeyVoiceStateIteratorPrefix(guildID string) []byte {
 
 	return buf
 }
+
+func KeyShardSession(shardID int) []byte {
+	// 1 keytype, 8 shardID
+	buf := make([]byte, 9)
+	buf[0] = byte(KeyTypeShardSession)
+
+	binary.BigEndian.PutUint64(buf[1:], uint64(shardID))
+
+	return buf
+}
+
+func KeyMemberLoadProgress(guildID string) []byte {
+	// 1 keytype, 8 guildID
+	buf := make([]byte, 9)
+	buf[0] = byte(KeyTypeMemberLoadProgress)
+
+	parsedG, _ := strconv.ParseUint(guildID, 10, 64)
+	binary.BigEndian.PutUint64(buf[1:], parsedG)
+
+	return buf
+}
+
+func KeyMessageReaction(channelID, messageID, emoji, userID string) []byte {
+	// 1 keytype, 8 channelID, 8 messageID, 1 emoji length, emoji, 8 userID
+	buf := KeyMessageReactionEmojiIteratorPrefix(channelID, messageID, emoji)
+
+	parsedU, _ := strconv.ParseUint(userID, 10, 64)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], parsedU)
+
+	return buf
+}
+
+func KeyMessageReactionEmojiIteratorPrefix(channelID, messageID, emoji string) []byte {
+	// 1 keytype, 8 channelID, 8 messageID, 1 emoji length, emoji
+	if len(emoji) > 255 {
+		emoji = emoji[:255]
+	}
+
+	buf := make([]byte, 18+len(emoji), 18+len(emoji)+8)
+	copy(buf, KeyMessageReactionsIteratorPrefix(channelID, messageID))
+	buf[17] = byte(len(emoji))
+	copy(buf[18:], emoji)
+
+	return buf
+}
+
+func KeyMessageReactionsIteratorPrefix(channelID, messageID string) []byte {
+	// 1 keytype, 8 channelID, 8 messageID
+	buf := make([]byte, 17)
+	buf[0] = byte(KeyTypeMessageReaction)
+
+	parsedC, _ := strconv.ParseUint(channelID, 10, 64)
+	binary.BigEndian.PutUint64(buf[1:], parsedC)
+
+	parsedM, _ := strconv.ParseUint(messageID, 10, 64)
+	binary.BigEndian.PutUint64(buf[9:], parsedM)
+
+	return buf
+}
+
+func KeyMemberName(guildID, name, userID string) []byte {
+	// 1 keytype, 8 guildID, name, 1 separator, 8 userID
+	buf := KeyMemberNameIteratorPrefix(guildID, name)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	parsedU, _ := strconv.ParseUint(userID, 10, 64)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], parsedU)
+
+	return buf
+}
+
+// KeyMemberNameIteratorPrefix returns the prefix of the names in the member name index starting with namePrefix
+// the name should already be lowercased
+func KeyMemberNameIteratorPrefix(guildID, namePrefix string) []byte {
+	// 1 keytype, 8 guildID, name
+	buf := make([]byte, 9+len(namePrefix), 9+len(namePrefix)+9)
+	buf[0] = byte(KeyTypeMemberName)
+
+	parsedG, _ := strconv.ParseUint(guildID, 10, 64)
+	binary.BigEndian.PutUint64(buf[1:], parsedG)
+
+	copy(buf[9:], namePrefix)
+
+	return buf
+}
+
+func KeyRoleMember(guildID, roleID, userID string) []byte {
+	// 1 keytype, 8 guildID, 8 roleID, 8 userID
+	buf := make([]byte, 25)
+	copy(buf, KeyRoleMembersIteratorPrefix(guildID, roleID))
+
+	parsedU, _ := strconv.ParseUint(userID, 10, 64)
+	binary.BigEndian.PutUint64(buf[17:], parsedU)
+
+	return buf
+}
+
+func KeyRoleMembersIteratorPrefix(guildID, roleID string) []byte {
+	// 1 keytype, 8 guildID, 8 roleID
+	buf := make([]byte, 17)
+	buf[0] = byte(KeyTypeRoleMember)
+
+	parsedG, _ := strconv.ParseUint(guildID, 10, 64)
+	binary.BigEndian.PutUint64(buf[1:], parsedG)
+
+	parsedR, _ := strconv.ParseUint(roleID, 10, 64)
+	binary.BigEndian.PutUint64(buf[9:], parsedR)
+
+	return buf
+}
+
+func KeyVoiceChannelMember(channelID, userID string) []byte {
+	// 1 keytype, 8 channelID, 8 userID
+	buf := make([]byte, 17)
+	copy(buf, KeyVoiceChannelMembersIteratorPrefix(channelID))
+
+	parsedU, _ := strconv.ParseUint(userID, 10, 64)
+	binary.BigEndian.PutUint64(buf[9:], parsedU)
+
+	return buf
+}
+
+func KeyVoiceChannelMembersIteratorPrefix(channelID string) []byte {
+	// 1 keytype, 8 channelID
+	buf := make([]byte, 9)
+	buf[0] = byte(KeyTypeVoiceChannelMember)
+
+	parsedC, _ := strconv.ParseUint(channelID, 10, 64)
+	binary.BigEndian.PutUint64(buf[1:], parsedC)
+
+	return buf
+}
+
+func KeyGuildUserMessage(guildID, userID, messageID string) []byte {
+	// 1 keytype, 8 guildID, 8 userID, 8 messageID
+	buf := make([]byte, 25)
+	copy(buf, KeyGuildUserMessagesIteratorPrefix(guildID, userID))
+
+	parsedM, _ := strconv.ParseUint(messageID, 10, 64)
+	binary.BigEndian.PutUint64(buf[17:], parsedM)
+
+	return buf
+}
+
+func KeyGuildUserMessagesIteratorPrefix(guildID, userID string) []byte {
+	// 1 keytype, 8 guildID, 8 userID
+	buf := make([]byte, 17)
+	buf[0] = byte(KeyTypeGuildUserMessage)
+
+	parsedG, _ := strconv.ParseUint(guildID, 10, 64)
+	binary.BigEndian.PutUint64(buf[1:], parsedG)
+
+	parsedU, _ := strconv.ParseUint(userID, 10, 64)
+	binary.BigEndian.PutUint64(buf[9:], parsedU)
+
+	return buf
+}
+
+func KeyChannelUserMessage(channelID, userID, messageID string) []byte {
+	// 1 keytype, 8 channelID, 8 userID, 8 messageID
+	buf := make([]byte, 25)
+	copy(buf, KeyChannelUserMessagesIteratorPrefix(channelID, userID))
+
+	parsedM, _ := strconv.ParseUint(messageID, 10, 64)
+	binary.BigEndian.PutUint64(buf[17:], parsedM)
+
+	return buf
+}
+
+func KeyChannelUserMessagesIteratorPrefix(channelID, userID string) []byte {
+	// 1 keytype, 8 channelID, 8 userID
+	buf := make([]byte, 17)
+	buf[0] = byte(KeyTypeChannelUserMessage)
+
+	parsedC, _ := strconv.ParseUint(channelID, 10, 64)
+	binary.BigEndian.PutUint64(buf[1:], parsedC)
+
+	parsedU, _ := strconv.ParseUint(userID, 10, 64)
+	binary.BigEndian.PutUint64(buf[9:], parsedU)
+
+	return buf
+}
+
+func KeyGuildUnavailable(guildID string) []byte {
+	return KeyIDPrefix(KeyTypeGuildUnavailable, guildID)
+}
+
+func KeyGuildRole(guildID, roleID string) []byte {
+	// 1 keytype, 8 guildID, 8 roleID
+	buf := make([]byte, 17)
+	copy(buf, KeyGuildRolesIteratorPrefix(guildID))
+
+	parsed, _ := strconv.ParseUint(roleID, 10, 64)
+	binary.BigEndian.PutUint64(buf[9:], parsed)
+
+	return buf
+}
+
+func KeyGuildRolesIteratorPrefix(guildID string) []byte {
+	return KeyIDPrefix(KeyTypeGuildRole, guildID)
+}
+
+func KeyGuildEmoji(guildID, emojiID string) []byte {
+	// 1 keytype, 8 guildID, 8 emojiID
+	buf := make([]byte, 17)
+	copy(buf, KeyGuildEmojisIteratorPrefix(guildID))
+
+	parsed, _ := strconv.ParseUint(emojiID, 10, 64)
+	binary.BigEndian.PutUint64(buf[9:], parsed)
+
+	return buf
+}
+
+func KeyGuildEmojisIteratorPrefix(guildID string) []byte {
+	return KeyIDPrefix(KeyTypeGuildEmoji, guildID)
+}
+
+func KeyGuildChannel(guildID, channelID string) []byte {
+	// 1 keytype, 8 guildID, 8 channelID
+	buf := make([]byte, 17)
+	copy(buf, KeyGuildChannelsIteratorPrefix(guildID))
+
+	parsed, _ := strconv.ParseUint(channelID, 10, 64)
+	binary.BigEndian.PutUint64(buf[9:], parsed)
+
+	return buf
+}
+
+func KeyGuildChannelsIteratorPrefix(guildID string) []byte {
+	return KeyIDPrefix(KeyTypeGuildChannel, guildID)
+}
+
+func KeyDMChannel(channelID string) []byte {
+	return KeyIDPrefix(KeyTypeDMChannel, channelID)
+}
+
+func KeyUserDMChannel(userID string) []byte {
+	return KeyIDPrefix(KeyTypeUserDMChannel, userID)
+}
@@ -0,0 +1,149 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// MemberLoadProgress is the progress of loading the members of a guild
+// Large guilds only include the online members in GuildCreate, the rest have to be requested (see discordgo.Session.RequestGuildMembers)
+// and are received in GuildMembersChunk events
+//
+// It's reset every time a GuildCreate for the guild is received
+type MemberLoadProgress struct {
+	GuildID string
+
+	// Number of members included in the GuildCreate event
+	InitialMembers int
+
+	// Number of GuildMembersChunk events received, and the number of members in them
+	// Note that ChunkedMembers can include the same member multiple times (e.g if they were requested again)
+	Chunks         int
+	ChunkedMembers int
+
+	// MemberCount of the guild when the last chunk was received
+	MemberCount int
+
+	// Number of members of the guild in state, counted when the GuildCreate is received
+	// and kept up to date with the members added and removed until the members are fully loaded
+	LoadedMembers int
+
+	// Set when all the members of the guild have been loaded, either through GuildCreate or the chunks
+	// this is decided from the number of members in state, not ChunkedMembers
+	FullyLoaded bool
+}
+
+// GuildMembersLoadProgress returns the progress of loading the members of a guild
+// Returns ErrNotFound if no GuildCreate has been received for the guild
+func (s *State) GuildMembersLoadProgress(guildID string) (st *MemberLoadProgress, err error) {
+	_, err = s.GetKey(nil, KeyMemberLoadProgress(guildID), &st)
+	return
+}
+
+// GuildMembersLoaded returns true if all the members of the guild has been loaded into state
+func (s *State) GuildMembersLoaded(guildID string) bool {
+	progress, err := s.GuildMembersLoadProgress(guildID)
+	if err != nil {
+		return false
+	}
+
+	return progress.FullyLoaded
+}
+
+// membersPartiallyLoaded returns true if not all the members of the guild are loaded into state
+func (w *shardWorker) membersPartiallyLoaded(txn Txn, guildID string) (bool, error) {
+	progress, err := w.memberLoadProgress(txn, guildID)
+	if err != nil {
+		if err == ErrNotFound {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	return !progress.FullyLoaded, nil
+}
+
+// initMemberLoadProgress resets the member load progress of a guild, called after the members from GuildCreate has been loaded
+// A guild without a MemberCount (e.g a GuildCreate merged from partial data) is never marked as fully loaded from it
+func (w *shardWorker) initMemberLoadProgress(g *discordgo.Guild) error {
+	return w.update(func(txn Txn) error {
+		// Members can be left in state from before the GuildCreate, so they're counted instead of using len(g.Members)
+		// this is the only time all the members are counted while loading them
+		n, err := w.State.CountGuildMembersWithTxn(txn, g.ID)
+		if err != nil {
+			return err
+		}
+
+		progress := &MemberLoadProgress{
+			GuildID:        g.ID,
+			InitialMembers: len(g.Members),
+			MemberCount:    g.MemberCount,
+			LoadedMembers:  n,
+			FullyLoaded:    !g.Unavailable && g.MemberCount > 0 && n >= g.MemberCount,
+		}
+
+		return w.setKey(txn, KeyMemberLoadProgress(g.ID), progress)
+	})
+}
+
+// MembersChunk loads the members from a GuildMembersChunk event and updates the load progress of the guild
+func (w *shardWorker) MembersChunk(chunk *discordgo.GuildMembersChunk) error {
+	added, err := w.LoadMembers(chunk.GuildID, chunk.Members)
+	if err != nil {
+		return err
+	}
+
+	return w.update(func(txn Txn) error {
+		progress, err := w.memberLoadProgress(txn, chunk.GuildID)
+		if err != nil {
+			if err != ErrNotFound {
+				return err
+			}
+
+			progress = &MemberLoadProgress{GuildID: chunk.GuildID}
+		}
+
+		guild, err := w.guild(txn, chunk.GuildID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		if guild != nil {
+			progress.MemberCount = guild.MemberCount
+		}
+
+		progress.Chunks++
+		progress.ChunkedMembers += len(chunk.Members)
+		if !progress.FullyLoaded {
+			progress.LoadedMembers += added
+			progress.FullyLoaded = progress.MemberCount > 0 && progress.LoadedMembers >= progress.MemberCount
+		}
+
+		return w.setKey(txn, KeyMemberLoadProgress(chunk.GuildID), progress)
+	})
+}
+
+// addLoadedMembers adjusts the number of members in state in the load progress of the guild by delta,
+// for members added and removed outside of the chunks, nothing is done once the members are fully loaded
+func (w *shardWorker) addLoadedMembers(txn Txn, guildID string, delta int) error {
+	progress, err := w.memberLoadProgress(txn, guildID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+
+		return err
+	}
+
+	if progress.FullyLoaded {
+		return nil
+	}
+
+	progress.LoadedMembers += delta
+	return w.setKey(txn, KeyMemberLoadProgress(guildID), progress)
+}
+
+func (w *shardWorker) memberLoadProgress(txn Txn, guildID string) (st *MemberLoadProgress, err error) {
+	_, w.decodeBuffer, err = w.State.GetKeyWithBuffer(txn, KeyMemberLoadProgress(guildID), w.decodeBuffer, &st)
+	return
+}
@@ -0,0 +1,206 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"reflect"
+)
+
+// mergeMode decides how a field of a partial update is merged into the object in state
+type mergeMode int
+
+const (
+	// mergeIgnore keeps the value in state, used for fields that are not part of the update or are tracked elsewhere
+	mergeIgnore mergeMode = iota
+	// mergeAuthoritative always overwrites the value in state, even with the zero value
+	mergeAuthoritative
+	// mergeNonEmpty only overwrites the value in state if the new value is not the zero value
+	// note that a empty but non nil slice is not the zero value, so it still overwrites (e.g all embeds being removed)
+	mergeNonEmpty
+	// mergeFullUpdate is the same as mergeAuthoritative, but only in full updates, see newMergePolicy
+	mergeFullUpdate
+)
+
+type mergeField struct {
+	index int
+	mode  mergeMode
+}
+
+// mergePolicy lists how every field of a struct is merged in a partial update, see newMergePolicy
+type mergePolicy struct {
+	t      reflect.Type
+	fields []mergeField
+	modes  map[string]mergeMode
+
+	// Index of the field marking a full update, -1 if there is none
+	fullUpdateIndex int
+	fullUpdateField string
+
+	// Fields in the policy that the type does not have, see TestMergePoliciesComplete
+	unknownFields []string
+}
+
+// newMergePolicy creates a merge policy for the type of v from fields, a map of field names to how they're merged
+// fields that are not listed are ignored, but all fields should be listed so that it's clear nothing was missed when
+// the discordgo types change (see TestMergePoliciesComplete)
+//
+// If fullUpdateField is set, the update is a full update when that field is not the zero value in it, otherwise
+// fields with mergeFullUpdate are never merged
+//
+// Fields that v does not have are skipped, as they may have been renamed or removed in the discordgo version in use
+func newMergePolicy(v interface{}, fullUpdateField string, fields map[string]mergeMode) *mergePolicy {
+	t := reflect.TypeOf(v)
+	p := &mergePolicy{
+		t:               t,
+		modes:           fields,
+		fullUpdateIndex: -1,
+		fullUpdateField: fullUpdateField,
+	}
+
+	if fullUpdateField != "" {
+		if f, ok := t.FieldByName(fullUpdateField); ok && len(f.Index) == 1 {
+			p.fullUpdateIndex = f.Index[0]
+		} else {
+			p.unknownFields = append(p.unknownFields, fullUpdateField)
+		}
+	}
+
+	for name, mode := range fields {
+		f, ok := t.FieldByName(name)
+		if !ok || len(f.Index) != 1 {
+			p.unknownFields = append(p.unknownFields, name)
+			continue
+		}
+
+		if mode != mergeIgnore {
+			p.fields = append(p.fields, mergeField{index: f.Index[0], mode: mode})
+		}
+	}
+
+	return p
+}
+
+// merge merges src into dst according to the policy, both have to be pointers to the type of the policy
+func (p *mergePolicy) merge(dst, src interface{}) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src).Elem()
+	if dv.Type() != p.t || sv.Type() != p.t {
+		panic("dbstate: merging " + dv.Type().String() + " with the policy of " + p.t.String())
+	}
+
+	fullUpdate := p.fullUpdateIndex != -1 && !sv.Field(p.fullUpdateIndex).IsZero()
+
+	for _, f := range p.fields {
+		v := sv.Field(f.index)
+		if f.mode == mergeNonEmpty && v.IsZero() {
+			continue
+		}
+
+		if f.mode == mergeFullUpdate && !fullUpdate {
+			continue
+		}
+
+		dv.Field(f.index).Set(v)
+	}
+}
+
+// guildUpdateMergePolicy is used in GuildUpdate, the GUILD_UPDATE payload is the full guild without the fields only sent in GUILD_CREATE
+var guildUpdateMergePolicy = newMergePolicy(discordgo.Guild{}, "", map[string]mergeMode{
+	"Name":                        mergeAuthoritative,
+	"Icon":                        mergeAuthoritative,
+	"Region":                      mergeAuthoritative,
+	"AfkChannelID":                mergeAuthoritative,
+	"EmbedChannelID":              mergeAuthoritative,
+	"OwnerID":                     mergeAuthoritative,
+	"Splash":                      mergeAuthoritative,
+	"AfkTimeout":                  mergeAuthoritative,
+	"VerificationLevel":           mergeAuthoritative,
+	"EmbedEnabled":                mergeAuthoritative,
+	"DefaultMessageNotifications": mergeAuthoritative,
+	"ExplicitContentFilter":       mergeAuthoritative,
+	"Features":                    mergeAuthoritative,
+	"MfaLevel":                    mergeAuthoritative,
+	"WidgetEnabled":               mergeAuthoritative,
+	"WidgetChannelID":             mergeAuthoritative,
+	"SystemChannelID":             mergeAuthoritative,
+	"VanityURLCode":               mergeAuthoritative,
+	"Description":                 mergeAuthoritative,
+	"Banner":                      mergeAuthoritative,
+	"PremiumTier":                 mergeAuthoritative,
+	"PremiumSubscriptionCount":    mergeAuthoritative,
+
+	// Only sent in GUILD_CREATE
+	"JoinedAt":    mergeIgnore,
+	"Large":       mergeIgnore,
+	"MemberCount": mergeIgnore,
+	"Unavailable": mergeIgnore,
+	"Members":     mergeIgnore,
+	"Presences":   mergeIgnore,
+	"Channels":    mergeIgnore,
+	"VoiceStates": mergeIgnore,
+
+	// Updated through their own events
+	"Roles":  mergeIgnore,
+	"Emojis": mergeIgnore,
+
+	"ID": mergeIgnore,
+})
+
+// messageUpdateMergePolicy is used in MessageCreateUpdate, MESSAGE_UPDATE can be partial (e.g when only the embeds were resolved)
+// partial updates don't include the author
+var messageUpdateMergePolicy = newMergePolicy(discordgo.Message{}, "Author", map[string]mergeMode{
+	"GuildID":         mergeNonEmpty,
+	"Content":         mergeNonEmpty,
+	"Timestamp":       mergeNonEmpty,
+	"EditedTimestamp": mergeNonEmpty,
+	"MentionRoles":    mergeNonEmpty,
+	"Author":          mergeNonEmpty,
+	"Attachments":     mergeNonEmpty,
+	"Embeds":          mergeNonEmpty,
+	"Mentions":        mergeNonEmpty,
+	"Member":          mergeNonEmpty,
+
+	// These can't be told apart from being left out of a partial update
+	"MentionEveryone": mergeFullUpdate,
+	"Pinned":          mergeFullUpdate,
+
+	// Don't change after creation
+	"Tts":       mergeIgnore,
+	"Type":      mergeIgnore,
+	"WebhookID": mergeIgnore,
+
+	// Updated through the reaction events
+	"Reactions": mergeIgnore,
+
+	"ID":        mergeIgnore,
+	"ChannelID": mergeIgnore,
+})
+
+// presenceUpdateMergePolicy is used in PresenceAddUpdate, the user is merged with presenceUserMergePolicy
+var presenceUpdateMergePolicy = newMergePolicy(discordgo.Presence{}, "", map[string]mergeMode{
+	"Status": mergeNonEmpty,
+	"Roles":  mergeNonEmpty,
+
+	// A nil game means the user stopped playing
+	"Game": mergeAuthoritative,
+	"Nick": mergeAuthoritative,
+
+	"Since": mergeIgnore,
+	"User":  mergeIgnore,
+})
+
+// presenceUserMergePolicy is used for the user in PresenceAddUpdate, the user in PRESENCE_UPDATE only has the changed fields
+var presenceUserMergePolicy = newMergePolicy(discordgo.User{}, "", map[string]mergeMode{
+	"Username":      mergeNonEmpty,
+	"Discriminator": mergeNonEmpty,
+	"Avatar":        mergeNonEmpty,
+	"Bot":           mergeNonEmpty,
+
+	// Only sent for the current user
+	"Email":      mergeIgnore,
+	"Locale":     mergeIgnore,
+	"Token":      mergeIgnore,
+	"Verified":   mergeIgnore,
+	"MFAEnabled": mergeIgnore,
+
+	"ID": mergeIgnore,
+})
@@ -0,0 +1,202 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"reflect"
+	"testing"
+)
+
+var testMergePolicies = []*mergePolicy{guildUpdateMergePolicy, messageUpdateMergePolicy, presenceUpdateMergePolicy, presenceUserMergePolicy}
+
+func TestMergePoliciesComplete(t *testing.T) {
+	for _, p := range testMergePolicies {
+		for i := 0; i < p.t.NumField(); i++ {
+			name := p.t.Field(i).Name
+			if _, ok := p.modes[name]; !ok {
+				t.Errorf("%s.%s is missing from the merge policy", p.t, name)
+			}
+		}
+
+		for _, name := range p.unknownFields {
+			t.Errorf("%s has no field %s from the merge policy", p.t, name)
+		}
+	}
+}
+
+func TestMergePolicyUnknownField(t *testing.T) {
+	p := newMergePolicy(discordgo.User{}, "Missing", map[string]mergeMode{"Username": mergeAuthoritative, "Renamed": mergeAuthoritative})
+	if len(p.unknownFields) != 2 {
+		t.Errorf("unexpected unknown fields: %v", p.unknownFields)
+	}
+
+	dst := &discordgo.User{}
+	p.merge(dst, &discordgo.User{Username: "a"})
+	if dst.Username != "a" {
+		t.Error("known field not merged")
+	}
+}
+
+func TestMergePolicies(t *testing.T) {
+	for _, p := range testMergePolicies {
+		for i := 0; i < p.t.NumField(); i++ {
+			field := p.t.Field(i)
+			mode := p.modes[field.Name]
+
+			t.Run(p.t.Name()+"."+field.Name, func(t *testing.T) {
+				nonZero := testNonZeroValue(field.Type)
+
+				// New value on a empty field, in a partial update
+				dst := reflect.New(p.t)
+				src := reflect.New(p.t)
+				src.Elem().Field(field.Index[0]).Set(nonZero)
+				p.merge(dst.Interface(), src.Interface())
+
+				merged := dst.Elem().Field(field.Index[0])
+				if (mode == mergeIgnore || mode == mergeFullUpdate) && !merged.IsZero() {
+					t.Error("field was merged")
+				} else if (mode == mergeAuthoritative || mode == mergeNonEmpty) && !reflect.DeepEqual(merged.Interface(), nonZero.Interface()) {
+					t.Error("field was not merged")
+				}
+
+				// Empty value on a set field, in a partial update
+				dst = reflect.New(p.t)
+				dst.Elem().Field(field.Index[0]).Set(nonZero)
+				src = reflect.New(p.t)
+				p.merge(dst.Interface(), src.Interface())
+
+				merged = dst.Elem().Field(field.Index[0])
+				if mode == mergeAuthoritative && !merged.IsZero() {
+					t.Error("authoritative field was not cleared")
+				} else if mode != mergeAuthoritative && merged.IsZero() {
+					t.Error("field was cleared by a empty value")
+				}
+
+				if mode != mergeFullUpdate {
+					return
+				}
+
+				// New value on a empty field, and a empty value on a set field, in a full update
+				fullUpdate := testNonZeroValue(p.t.Field(p.fullUpdateIndex).Type)
+
+				dst = reflect.New(p.t)
+				src = reflect.New(p.t)
+				src.Elem().Field(field.Index[0]).Set(nonZero)
+				src.Elem().Field(p.fullUpdateIndex).Set(fullUpdate)
+				p.merge(dst.Interface(), src.Interface())
+				if !reflect.DeepEqual(dst.Elem().Field(field.Index[0]).Interface(), nonZero.Interface()) {
+					t.Error("field was not merged in a full update")
+				}
+
+				src.Elem().Field(field.Index[0]).Set(reflect.Zero(field.Type))
+				p.merge(dst.Interface(), src.Interface())
+				if !dst.Elem().Field(field.Index[0]).IsZero() {
+					t.Error("field was not cleared in a full update")
+				}
+			})
+		}
+	}
+}
+
+// testNonZeroValue returns a value of type t that's not the zero value
+func testNonZeroValue(t reflect.Type) reflect.Value {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString("a")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1)
+	case reflect.Slice:
+		v.Set(reflect.Append(v, testNonZeroValue(t.Elem())))
+	case reflect.Ptr:
+		v.Set(reflect.New(t.Elem()))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(t))
+	case reflect.Struct:
+		v.Field(0).Set(testNonZeroValue(t.Field(0).Type))
+	default:
+		panic("unsupported kind " + t.Kind().String())
+	}
+
+	return v
+}
+
+func TestGuildUpdateFields(t *testing.T) {
+	state, err := NewState(1, Options{Store: NewMemoryStore()})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{
+		ID:              "1",
+		Name:            "before",
+		MemberCount:     10,
+		SystemChannelID: "10",
+		Roles:           []*discordgo.Role{{ID: "100"}},
+	}}), "failed handling guild create")
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildUpdate{Guild: &discordgo.Guild{
+		ID:                    "1",
+		Name:                  "after",
+		Features:              []string{"VANITY_URL"},
+		MfaLevel:              1,
+		ExplicitContentFilter: 2,
+		Banner:                "banner",
+		VanityURLCode:         "vanity",
+	}}), "failed handling guild update")
+
+	g, err := state.Guild("1")
+	AssertFatal(t, err, "failed retrieving guild")
+
+	if g.Name != "after" {
+		t.Errorf("name not updated: %q", g.Name)
+	}
+	if len(g.Features) != 1 || g.Features[0] != "VANITY_URL" {
+		t.Errorf("features not updated: %v", g.Features)
+	}
+	if g.MfaLevel != 1 {
+		t.Errorf("mfa level not updated: %d", g.MfaLevel)
+	}
+	if g.ExplicitContentFilter != 2 {
+		t.Errorf("explicit content filter not updated: %d", g.ExplicitContentFilter)
+	}
+	if g.SystemChannelID != "" {
+		t.Errorf("removed system channel kept: %q", g.SystemChannelID)
+	}
+	if g.Banner != "banner" {
+		t.Errorf("banner not updated: %q", g.Banner)
+	}
+	if g.VanityURLCode != "vanity" {
+		t.Errorf("vanity url code not updated: %q", g.VanityURLCode)
+	}
+
+	// Not part of the update
+	if g.MemberCount != 10 || len(g.Roles) != 1 {
+		t.Errorf("fields outside of the update changed: %#v", g)
+	}
+}
+
+func TestMessageUpdatePinned(t *testing.T) {
+	state, err := NewState(1, Options{Store: NewMemoryStore(), TrackMessages: true})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	author := &discordgo.User{ID: "5"}
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageCreate{Message: &discordgo.Message{ID: "50", ChannelID: "10", Content: "a", Author: author}}), "failed handling message create")
+
+	// Full update, pinning the message
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageUpdate{Message: &discordgo.Message{ID: "50", ChannelID: "10", Content: "a", Author: author, Pinned: true}}), "failed handling message update")
+
+	// Partial update, should not unpin it
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.MessageUpdate{Message: &discordgo.Message{ID: "50", ChannelID: "10", Embeds: []*discordgo.MessageEmbed{}}}), "failed handling message update")
+
+	msg, _, err := state.ChannelMessage("10", "50")
+	AssertFatal(t, err, "failed retrieving message")
+	if !msg.Pinned {
+		t.Error("pin not stored")
+	}
+}
@@ -0,0 +1,520 @@
+package dbstate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+var (
+	// Returned by NewState when Options.DryRunMigrations is set and there were migrations to run
+	ErrMigrationDryRun = errors.New("Migrations were only dry ran, the database has not been migrated.")
+
+	// Used when a previous migration was interrupted, leaving the database in a partially migrated state
+	ErrMigrationInterrupted = errors.New("A previous migration was interrupted, the database is in an inconsistent state.")
+)
+
+// DefaultMigrationBatchSize is the number of keys migrated per transaction if Options.MigrationBatchSize is not set
+const DefaultMigrationBatchSize = 1000
+
+// MigrationEntry is a single key value pair passed through a migration
+type MigrationEntry struct {
+	Key       []byte
+	Value     []byte
+	UserMeta  byte
+	ExpiresAt uint64
+}
+
+func (e *MigrationEntry) equal(other *MigrationEntry) bool {
+	return bytes.Equal(e.Key, other.Key) && bytes.Equal(e.Value, other.Value) && e.UserMeta == other.UserMeta && e.ExpiresAt == other.ExpiresAt
+}
+
+// Migration upgrades the database from format version From to From+1
+type Migration struct {
+	From        int
+	Description string
+
+	// KeyTypes limits the migration to keys of these types, if empty it's ran on all keys except KeyMeta
+	KeyTypes []KeyType
+
+	// Migrate returns the entries that should replace e
+	// the key of e is always deleted before the returned entries are written, so returning e keeps it, and returning nothing deletes it
+	// The key and value slices of e should be replaced rather than modified in place
+	Migrate func(s *State, e *MigrationEntry) ([]*MigrationEntry, error)
+}
+
+// migrations is the registry of all migrations, there should be one for every format version bump that can be migrated
+var migrations = []*Migration{
+	migrationV3BigEndianKeys,
+	migrationV4MemberNameIndex,
+	migrationV5RoleMemberIndex,
+	migrationV6VoiceChannelIndex,
+	migrationV7MessageAuthorIndex,
+	migrationV8SplitGuild,
+	migrationV9DMChannelIndex,
+	migrationV10GuildChannels,
+}
+
+// v4: changed the endiannes of keys to big endian
+var migrationV3BigEndianKeys = &Migration{
+	From:        3,
+	Description: "Convert the ids in keys from little endian to big endian",
+	KeyTypes:    []KeyType{KeyTypeGuild, KeyTypeMember, KeyTypeChannel, KeyTypeChannelMessage, KeyTypePresence, KeyTypeVoiceState},
+	Migrate: func(s *State, e *MigrationEntry) ([]*MigrationEntry, error) {
+		if (len(e.Key)-1)%8 != 0 {
+			return nil, errors.Errorf("unexpected key length %d", len(e.Key))
+		}
+
+		newKey := make([]byte, len(e.Key))
+		newKey[0] = e.Key[0]
+		for i := 1; i < len(e.Key); i += 8 {
+			binary.BigEndian.PutUint64(newKey[i:], binary.LittleEndian.Uint64(e.Key[i:]))
+		}
+
+		e.Key = newKey
+		return []*MigrationEntry{e}, nil
+	},
+}
+
+// v5: added the member name index
+var migrationV4MemberNameIndex = &Migration{
+	From:        4,
+	Description: "Build the member name index",
+	KeyTypes:    []KeyType{KeyTypeMember},
+	Migrate: func(s *State, e *MigrationEntry) ([]*MigrationEntry, error) {
+		if len(e.Key) != 17 {
+			return nil, errors.Errorf("unexpected key length %d", len(e.Key))
+		}
+
+		var m *discordgo.Member
+		err := s.DecodeData(e.Value, &m)
+		if err != nil {
+			return nil, err
+		}
+
+		guildID := strconv.FormatUint(binary.BigEndian.Uint64(e.Key[1:]), 10)
+		userID := strconv.FormatUint(binary.BigEndian.Uint64(e.Key[9:]), 10)
+
+		result := []*MigrationEntry{e}
+		for _, v := range memberIndexNames(m) {
+			result = append(result, &MigrationEntry{Key: KeyMemberName(guildID, v, userID), Value: []byte{}})
+		}
+
+		return result, nil
+	},
+}
+
+// v6: added the role member index
+var migrationV5RoleMemberIndex = &Migration{
+	From:        5,
+	Description: "Build the role member index",
+	KeyTypes:    []KeyType{KeyTypeMember},
+	Migrate: func(s *State, e *MigrationEntry) ([]*MigrationEntry, error) {
+		if len(e.Key) != 17 {
+			return nil, errors.Errorf("unexpected key length %d", len(e.Key))
+		}
+
+		var m *discordgo.Member
+		err := s.DecodeData(e.Value, &m)
+		if err != nil {
+			return nil, err
+		}
+
+		guildID := strconv.FormatUint(binary.BigEndian.Uint64(e.Key[1:]), 10)
+		userID := strconv.FormatUint(binary.BigEndian.Uint64(e.Key[9:]), 10)
+
+		result := []*MigrationEntry{e}
+		for _, v := range m.Roles {
+			result = append(result, &MigrationEntry{Key: KeyRoleMember(guildID, v, userID), Value: []byte{}})
+		}
+
+		return result, nil
+	},
+}
+
+// v7: added the voice channel index
+var migrationV6VoiceChannelIndex = &Migration{
+	From:        6,
+	Description: "Build the voice channel index",
+	KeyTypes:    []KeyType{KeyTypeVoiceState},
+	Migrate: func(s *State, e *MigrationEntry) ([]*MigrationEntry, error) {
+		var vs *discordgo.VoiceState
+		err := s.DecodeData(e.Value, &vs)
+		if err != nil {
+			return nil, err
+		}
+
+		result := []*MigrationEntry{e}
+		if vs.ChannelID != "" {
+			result = append(result, &MigrationEntry{Key: KeyVoiceChannelMember(vs.ChannelID, vs.UserID), Value: idValue(vs.GuildID)})
+		}
+
+		return result, nil
+	},
+}
+
+// v8: added the message author index
+var migrationV7MessageAuthorIndex = &Migration{
+	From:        7,
+	Description: "Build the message author index",
+	KeyTypes:    []KeyType{KeyTypeChannelMessage},
+	Migrate: func(s *State, e *MigrationEntry) ([]*MigrationEntry, error) {
+		var m *discordgo.Message
+		err := s.DecodeData(e.Value, &m)
+		if err != nil {
+			return nil, err
+		}
+
+		result := []*MigrationEntry{e}
+		if m.Author == nil {
+			return result, nil
+		}
+
+		// Same as shardWorker.messageGuildID, the channels are not changed by this migration
+		guildID := m.GuildID
+		if guildID == "" {
+			var c *discordgo.Channel
+			_, err = s.GetKey(nil, KeyChannel(m.ChannelID), &c)
+			if err != nil && err != ErrNotFound {
+				return nil, err
+			}
+
+			if c != nil {
+				guildID = c.GuildID
+			}
+		}
+
+		// The index entries expire with the message, messages without a guild only get the channel index
+		result = append(result, &MigrationEntry{Key: KeyChannelUserMessage(m.ChannelID, m.Author.ID, m.ID), Value: []byte{}, ExpiresAt: e.ExpiresAt})
+		if guildID != "" {
+			result = append(result, &MigrationEntry{Key: KeyGuildUserMessage(guildID, m.Author.ID, m.ID), Value: idValue(m.ChannelID), ExpiresAt: e.ExpiresAt})
+		}
+
+		return result, nil
+	},
+}
+
+// v9: moved the roles, emojis and channel list of guilds to their own keys
+var migrationV8SplitGuild = &Migration{
+	From:        8,
+	Description: "Move the roles, emojis and channel list of guilds to their own keys",
+	KeyTypes:    []KeyType{KeyTypeGuild},
+	Migrate: func(s *State, e *MigrationEntry) ([]*MigrationEntry, error) {
+		var g *discordgo.Guild
+		err := s.DecodeData(e.Value, &g)
+		if err != nil {
+			return nil, err
+		}
+
+		var result []*MigrationEntry
+		for _, v := range g.Roles {
+			encoded, err := s.encodeData(nil, nil, v)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &MigrationEntry{Key: KeyGuildRole(g.ID, v.ID), Value: encoded})
+		}
+
+		for _, v := range g.Emojis {
+			encoded, err := s.encodeData(nil, nil, v)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &MigrationEntry{Key: KeyGuildEmoji(g.ID, v.ID), Value: encoded})
+		}
+
+		for _, v := range g.Channels {
+			result = append(result, &MigrationEntry{Key: KeyGuildChannel(g.ID, v.ID), Value: []byte{}})
+		}
+
+		g.Roles = nil
+		g.Emojis = nil
+		g.Channels = nil
+		encoded, err := s.encodeData(nil, nil, g)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Value = encoded
+		return append(result, e), nil
+	},
+}
+
+// v10: added the DM channel indexes
+var migrationV9DMChannelIndex = &Migration{
+	From:        9,
+	Description: "Build the DM channel indexes",
+	KeyTypes:    []KeyType{KeyTypeChannel},
+	Migrate: func(s *State, e *MigrationEntry) ([]*MigrationEntry, error) {
+		var c *discordgo.Channel
+		err := s.DecodeData(e.Value, &c)
+		if err != nil {
+			return nil, err
+		}
+
+		result := []*MigrationEntry{e}
+		if !isPrivateChannel(c) {
+			return result, nil
+		}
+
+		result = append(result, &MigrationEntry{Key: KeyDMChannel(c.ID), Value: []byte{}})
+		if c.Type == discordgo.ChannelTypeDM {
+			// Skip the self user like setDMChannelIndexes does, the in memory user is not loaded yet during migrations
+			var self *discordgo.User
+			_, err = s.GetKey(nil, KeySelfUser, &self)
+			if err != nil && err != ErrNotFound {
+				return nil, err
+			}
+
+			for _, v := range c.Recipients {
+				if self != nil && self.ID == v.ID {
+					continue
+				}
+
+				result = append(result, &MigrationEntry{Key: KeyUserDMChannel(v.ID), Value: idValue(c.ID)})
+			}
+		}
+
+		return result, nil
+	},
+}
+
+// v11: added all guild channel types to the channels of the guild
+var migrationV10GuildChannels = &Migration{
+	From:        10,
+	Description: "Add all guild channel types to the channels of the guild",
+	KeyTypes:    []KeyType{KeyTypeChannel},
+	Migrate: func(s *State, e *MigrationEntry) ([]*MigrationEntry, error) {
+		var c *discordgo.Channel
+		err := s.DecodeData(e.Value, &c)
+		if err != nil {
+			return nil, err
+		}
+
+		result := []*MigrationEntry{e}
+		if c.GuildID != "" && !isPrivateChannel(c) {
+			result = append(result, &MigrationEntry{Key: KeyGuildChannel(c.GuildID, c.ID), Value: []byte{}})
+		}
+
+		return result, nil
+	},
+}
+
+func findMigration(from int) *Migration {
+	for _, v := range migrations {
+		if v.From == from {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// checkMigratable returns an error if the database can't be migrated to the current FormatVersion
+// because a previous migration was interrupted or it's from a newer version
+func checkMigratable(meta *MetaInfo) error {
+	if meta.MigratingFrom != 0 {
+		return ErrMigrationInterrupted
+	}
+
+	if meta.FormatVersion > FormatVersion {
+		return ErrDifferentFormatVersion
+	}
+
+	return nil
+}
+
+// migrate runs all the migrations needed to bring the database up to the current FormatVersion
+func (s *State) migrate(meta *MetaInfo) error {
+	err := checkMigratable(meta)
+	if err != nil {
+		return err
+	}
+
+	ran := false
+	for meta.FormatVersion < FormatVersion {
+		m := findMigration(meta.FormatVersion)
+		if m == nil {
+			return errors.WithMessage(ErrDifferentFormatVersion, fmt.Sprintf("no migration from v%d", meta.FormatVersion))
+		}
+
+		ran = true
+		if s.opts.DryRunMigrations {
+			s.opts.Logger.LogInfo(fmt.Sprintf("[dry run] Migrating v%d -> v%d: %s", m.From, m.From+1, m.Description))
+
+			// Note that in dry run mode every migration sees the data unmodified by the migrations before it
+			err := s.runMigration(m)
+			if err != nil {
+				return errors.WithMessage(err, fmt.Sprintf("v%d", m.From))
+			}
+
+			meta.FormatVersion++
+			continue
+		}
+
+		s.opts.Logger.LogInfo(fmt.Sprintf("Migrating v%d -> v%d: %s", m.From, m.From+1, m.Description))
+
+		meta.MigratingFrom = m.From
+		err := s.setMeta(nil, meta)
+		if err != nil {
+			return err
+		}
+
+		err = s.runMigration(m)
+		if err != nil {
+			return errors.WithMessage(err, fmt.Sprintf("v%d", m.From))
+		}
+
+		meta.MigratingFrom = 0
+		meta.FormatVersion = m.From + 1
+		err = s.setMeta(nil, meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ran && s.opts.DryRunMigrations {
+		return ErrMigrationDryRun
+	}
+
+	return nil
+}
+
+// runMigration runs a single migration, reading from a single snapshot so that the keys written by the migration are not migrated again
+// and writing the changes in batches of Options.MigrationBatchSize
+func (s *State) runMigration(m *Migration) error {
+	batchSize := s.opts.MigrationBatchSize
+	if batchSize < 1 {
+		batchSize = DefaultMigrationBatchSize
+	}
+
+	prefixes := make([][]byte, 0, len(m.KeyTypes))
+	for _, v := range m.KeyTypes {
+		prefixes = append(prefixes, []byte{byte(v)})
+	}
+	if len(prefixes) < 1 {
+		prefixes = append(prefixes, []byte{})
+	}
+
+	started := time.Now()
+	processed := 0
+	changed := 0
+	lastLogged := 0
+
+	old := make([]*MigrationEntry, 0, batchSize)
+	replacements := make([][]*MigrationEntry, 0, batchSize)
+
+	flush := func() error {
+		if !s.opts.DryRunMigrations && len(old) > 0 {
+			err := s.RetryUpdate(func(txn Txn) error {
+				for i, e := range old {
+					err := txn.Delete(e.Key)
+					if err != nil {
+						return err
+					}
+
+					for _, r := range replacements[i] {
+						err = setRawEntry(txn, r.Key, r.Value, r.UserMeta, r.ExpiresAt)
+						if err != nil {
+							return err
+						}
+					}
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if processed-lastLogged >= 100000 {
+			s.opts.Logger.LogInfo(fmt.Sprintf("Migration v%d: processed %d keys, %d changed", m.From, processed, changed))
+			lastLogged = processed
+		}
+
+		old = old[:0]
+		replacements = replacements[:0]
+		return nil
+	}
+
+	err := s.Store.View(func(txn Txn) error {
+		for _, prefix := range prefixes {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				item := it.Item()
+				if bytes.Equal(item.Key(), KeyMeta) {
+					continue
+				}
+
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+
+				e := &MigrationEntry{
+					Key:       append([]byte{}, item.Key()...),
+					Value:     v,
+					UserMeta:  item.UserMeta(),
+					ExpiresAt: item.ExpiresAt(),
+				}
+
+				original := *e
+				r, err := m.Migrate(s, e)
+				if err != nil {
+					return errors.WithMessage(err, fmt.Sprintf("key %x", original.Key))
+				}
+
+				processed++
+				if len(r) == 1 && r[0].equal(&original) {
+					// Unchanged
+					continue
+				}
+
+				changed++
+				old = append(old, &original)
+				replacements = append(replacements, r)
+
+				if len(old) >= batchSize {
+					err = flush()
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		return flush()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.opts.Logger.LogInfo(fmt.Sprintf("Migration v%d done in %s: processed %d keys, %d changed", m.From, time.Since(started), processed, changed))
+	return nil
+}
+
+// setRawEntry writes an already encoded value, preserving the remaining ttl and the user meta
+func setRawEntry(txn Txn, key, value []byte, userMeta byte, expiresAt uint64) error {
+	if expiresAt > 0 {
+		ttl := time.Unix(int64(expiresAt), 0).Sub(time.Now())
+		if ttl <= 0 {
+			// Already expired
+			return nil
+		}
+
+		return txn.SetWithMetaTTL(key, value, userMeta, ttl)
+	}
+
+	if userMeta != 0 {
+		return txn.SetWithMeta(key, value, userMeta)
+	}
+
+	return txn.Set(key, value)
+}
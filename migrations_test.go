@@ -0,0 +1,134 @@
+package dbstate
+
+import (
+	"encoding/binary"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createV3DB creates a database with format version 3 containing a single message stored under a little endian key
+func createV3DB(t *testing.T, dir string) {
+	state, err := NewState(1, Options{DBOpts: RecommendedBadgerOptions(dir)})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	key := make([]byte, 17)
+	key[0] = byte(KeyTypeChannelMessage)
+	binary.LittleEndian.PutUint64(key[1:], 2)
+	binary.LittleEndian.PutUint64(key[9:], 3)
+
+	err = state.RetryUpdate(func(txn Txn) error {
+		err := state.setMeta(txn, &MetaInfo{FormatVersion: 3})
+		if err != nil {
+			return err
+		}
+
+		return state.SetKey(txn, nil, nil, key, &discordgo.Message{ID: "3", ChannelID: "2", Content: "hello"})
+	})
+	AssertFatal(t, err, "failed setting up v3 db")
+}
+
+func TestMigrateV3(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_migrate_v3")
+	defer os.RemoveAll(dir)
+	createV3DB(t, dir)
+
+	state, err := NewState(1, Options{DBOpts: RecommendedBadgerOptions(dir), KeepOldMessagesOnStart: true, MigrationBatchSize: 1})
+	AssertFatal(t, err, "failed migrating")
+	defer state.Close()
+
+	msg, _, err := state.ChannelMessage("2", "3")
+	AssertFatal(t, err, "failed retrieving migrated message")
+	if msg.Content != "hello" {
+		t.Errorf("mismatched content after migrating: %q", msg.Content)
+	}
+
+	meta, err := state.getMeta(nil)
+	AssertFatal(t, err, "failed retrieving meta")
+	if meta.FormatVersion != FormatVersion || meta.MigratingFrom != 0 {
+		t.Errorf("unexpected meta after migrating: %#v", meta)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_migrate_dry")
+	defer os.RemoveAll(dir)
+	createV3DB(t, dir)
+
+	_, err := NewState(1, Options{DBOpts: RecommendedBadgerOptions(dir), KeepOldMessagesOnStart: true, DryRunMigrations: true})
+	if errors.Cause(err) != ErrMigrationDryRun {
+		t.Fatal("expected ErrMigrationDryRun, got: ", err)
+	}
+}
+
+// setTestMeta replaces the meta of the database in dir
+func setTestMeta(t *testing.T, dir string, meta *MetaInfo) {
+	store, err := OpenBadgerStore(RecommendedBadgerOptions(dir))
+	AssertFatal(t, err, "failed opening store")
+	defer store.Close()
+
+	s := &State{Store: store, opts: &Options{Codec: &JSONCodec{}}}
+	AssertFatal(t, s.setMeta(nil, meta), "failed setting meta")
+}
+
+// v3MessageKept returns true if the message created by createV3DB is still in the database
+func v3MessageKept(t *testing.T, dir string) bool {
+	key := make([]byte, 17)
+	key[0] = byte(KeyTypeChannelMessage)
+	binary.LittleEndian.PutUint64(key[1:], 2)
+	binary.LittleEndian.PutUint64(key[9:], 3)
+
+	store, err := OpenBadgerStore(RecommendedBadgerOptions(dir))
+	AssertFatal(t, err, "failed opening store")
+	defer store.Close()
+
+	err = store.View(func(txn Txn) error {
+		_, err := txn.Get(key)
+		return err
+	})
+	if err != nil && err != ErrNotFound {
+		t.Fatal("failed retrieving message: ", err)
+	}
+
+	return err == nil
+}
+
+func TestMigrateDryRunKeepsData(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_migrate_dry_keep")
+	defer os.RemoveAll(dir)
+	createV3DB(t, dir)
+
+	// The state would normally be flushed after a unclean shutdown
+	setTestMeta(t, dir, &MetaInfo{FormatVersion: 3})
+
+	_, err := NewState(1, Options{DBOpts: RecommendedBadgerOptions(dir), KeepStateOnStart: true, DryRunMigrations: true})
+	if errors.Cause(err) != ErrMigrationDryRun {
+		t.Fatal("expected ErrMigrationDryRun, got: ", err)
+	}
+
+	if !v3MessageKept(t, dir) {
+		t.Error("data flushed in a dry run")
+	}
+}
+
+func TestMigrateNewerFormatKeepsData(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_migrate_newer")
+	defer os.RemoveAll(dir)
+	createV3DB(t, dir)
+
+	for _, meta := range []*MetaInfo{{FormatVersion: FormatVersion + 1}, {FormatVersion: 3, MigratingFrom: 3}} {
+		setTestMeta(t, dir, meta)
+
+		_, err := NewState(1, Options{DBOpts: RecommendedBadgerOptions(dir), KeepStateOnStart: true})
+		if cause := errors.Cause(err); cause != ErrDifferentFormatVersion && cause != ErrMigrationInterrupted {
+			t.Fatal("expected a format version error, got: ", err)
+		}
+
+		if !v3MessageKept(t, dir) {
+			t.Errorf("data flushed when opening a database with meta %#v", meta)
+		}
+	}
+}
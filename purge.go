@@ -0,0 +1,107 @@
+package dbstate
+
+import (
+	"encoding/binary"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+// PurgeGuild removes a guild and everything belonging to it from the state, this includes the members, voice states,
+// channels and the messages in them, and the indexes of those
+//
+// The channels are taken from the guild channel index, the voice states and the message author index,
+// so messages in channels that were already removed from the guild are purged aswell
+// This is done in multiple transactions to avoid going above the tx limit, so it's not atomic,
+// the guild itself is deleted last so that it can be retried if it fails partway
+func (s *State) PurgeGuild(guildID string) error {
+	err := s.purgeGuildData(guildID)
+	if err != nil {
+		return err
+	}
+
+	return s.RetryUpdate(func(txn Txn) error {
+		return txn.Delete(KeyGuild(guildID))
+	})
+}
+
+// purgeGuildData removes everything belonging to the guild except the guild entry itself
+func (s *State) purgeGuildData(guildID string) error {
+	var channels []string
+	err := s.Store.View(func(txn Txn) (err error) {
+		channels, err = s.guildChannelIDs(txn, guildID)
+		return
+	})
+	if err != nil {
+		return errors.WithMessage(err, "guildChannelIDs")
+	}
+
+	for _, c := range channels {
+		err = s.RetryUpdate(func(txn Txn) error {
+			return txn.Delete(KeyChannel(c))
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, t := range channelKeyTypes {
+			err = s.deleteKeysWithPrefixBatched(KeyIDPrefix(t, c))
+			if err != nil {
+				return errors.WithMessage(err, "channel "+c)
+			}
+		}
+	}
+
+	for _, t := range guildKeyTypes {
+		err = s.deleteKeysWithPrefixBatched(KeyIDPrefix(t, guildID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// guildChannelIDs returns the ids of all the channels in state belonging to the guild,
+// from the guild channel index, the voice states and the message author index
+func (s *State) guildChannelIDs(txn Txn, guildID string) ([]string, error) {
+	var channels []string
+	add := func(channelID string) {
+		if channelID != "" && !containsStr(channels, channelID) {
+			channels = append(channels, channelID)
+		}
+	}
+
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	prefix := KeyGuildChannelsIteratorPrefix(guildID)
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		add(strconv.FormatUint(binary.BigEndian.Uint64(it.Item().Key()[9:]), 10))
+	}
+	it.Close()
+
+	err := s.IterateGuildVoiceStates(txn, guildID, func(vs *discordgo.VoiceState) bool {
+		add(vs.ChannelID)
+		return true
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "IterateGuildVoiceStates")
+	}
+
+	// The values of the message author index are the channel ids
+	prefix = KeyIDPrefix(KeyTypeGuildUserMessage, guildID)
+	it = txn.NewIterator(DefaultIteratorOptions)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		v, err := it.Item().Value()
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+
+		add(strconv.FormatUint(binary.BigEndian.Uint64(v), 10))
+	}
+	it.Close()
+
+	return channels, nil
+}
@@ -0,0 +1,99 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"testing"
+)
+
+func TestGuildDeletePurge(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:              NewMemoryStore(),
+		TrackMembers:       true,
+		TrackChannels:      true,
+		TrackMessages:      true,
+		TrackReactionUsers: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	g := &discordgo.Guild{
+		ID:          "1",
+		MemberCount: 1,
+		Channels:    []*discordgo.Channel{{ID: "10", Type: discordgo.ChannelTypeGuildText}},
+		Members:     []*discordgo.Member{{User: &discordgo.User{ID: "5", Username: "bob"}, Roles: []string{"100"}}},
+		VoiceStates: []*discordgo.VoiceState{{UserID: "5", ChannelID: "20"}},
+	}
+
+	events := []interface{}{
+		&discordgo.GuildCreate{Guild: g},
+		&discordgo.MessageCreate{Message: &discordgo.Message{ID: "50", ChannelID: "10", GuildID: "1", Author: &discordgo.User{ID: "5"}}},
+		&discordgo.MessageReactionAdd{MessageReaction: &discordgo.MessageReaction{UserID: "5", ChannelID: "10", MessageID: "50", Emoji: discordgo.Emoji{Name: "a"}}},
+	}
+
+	for _, v := range events {
+		AssertFatal(t, state.HandleEventNoSync(0, v), "failed handling event")
+	}
+
+	// Outage, the guild data should be kept
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildDelete{Guild: &discordgo.Guild{ID: "1", Unavailable: true}}), "failed handling guild delete")
+	if _, err := state.GuildMember("1", "5"); err != nil {
+		t.Fatal("member removed on an unavailable guild delete: ", err)
+	}
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: g}), "failed handling guild create")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildDelete{Guild: &discordgo.Guild{ID: "1"}}), "failed handling guild delete")
+
+	assertOnlyMetaLeft(t, state)
+}
+
+func TestPurgeGuildWithoutChannels(t *testing.T) {
+	state, err := NewState(1, Options{
+		Store:         NewMemoryStore(),
+		TrackChannels: true,
+		TrackMessages: true,
+	})
+	AssertFatal(t, err, "failed creating state")
+	defer state.Close()
+
+	// The channel was removed from the guild, but there's still messages in it
+	events := []interface{}{
+		&discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1", Channels: []*discordgo.Channel{{ID: "10", Type: discordgo.ChannelTypeGuildText}}}},
+		&discordgo.MessageCreate{Message: &discordgo.Message{ID: "50", ChannelID: "10", GuildID: "1", Author: &discordgo.User{ID: "5"}}},
+		&discordgo.ChannelDelete{Channel: &discordgo.Channel{ID: "10", GuildID: "1"}},
+	}
+
+	for _, v := range events {
+		AssertFatal(t, state.HandleEventNoSync(0, v), "failed handling event")
+	}
+
+	// Simulate a earlier purge that failed after the guild entry was removed
+	err = state.RetryUpdate(func(txn Txn) error {
+		return txn.Delete(KeyGuild("1"))
+	})
+	AssertFatal(t, err, "failed deleting guild")
+
+	AssertFatal(t, state.PurgeGuild("1"), "failed purging guild")
+	assertOnlyMetaLeft(t, state)
+}
+
+// assertOnlyMetaLeft fails the test if there's anything but the meta left in the state
+func assertOnlyMetaLeft(t *testing.T, state *State) {
+	var left [][]byte
+	err := state.Store.View(func(txn Txn) error {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if KeyType(key[0]) == KeyType(KeyMeta[0]) {
+				continue
+			}
+
+			left = append(left, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	AssertFatal(t, err, "failed iterating keys")
+
+	if len(left) > 0 {
+		t.Errorf("%d keys left after deleting the guild, first: %q", len(left), left[0])
+	}
+}
@@ -0,0 +1,228 @@
+package dbstate
+
+import (
+	"encoding/binary"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+)
+
+// MessageReactionUsers returns the ID's of the users that reacted to a message with the emoji, requires Options.TrackReactionUsers
+// emoji is in the same format as discordgo.Emoji.APIName(), the emoji itself for unicode emojis or name:id for custom emojis
+func (s *State) MessageReactionUsers(channelID, messageID, emoji string) ([]string, error) {
+	return s.MessageReactionUsersWithTxn(nil, channelID, messageID, emoji)
+}
+
+// MessageReactionUsersWithTxn is the same as MessageReactionUsers but allows you to pass a transaction
+func (s *State) MessageReactionUsersWithTxn(txn Txn, channelID, messageID, emoji string) (users []string, err error) {
+	if txn == nil {
+		err = s.Store.View(func(txn Txn) error {
+			users, err = s.MessageReactionUsersWithTxn(txn, channelID, messageID, emoji)
+			return err
+		})
+		return
+	}
+
+	prefix := KeyMessageReactionEmojiIteratorPrefix(channelID, messageID, emoji)
+
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		if len(key) != len(prefix)+8 {
+			continue
+		}
+
+		userID := binary.BigEndian.Uint64(key[len(prefix):])
+		users = append(users, strconv.FormatUint(userID, 10))
+	}
+
+	return users, nil
+}
+
+// ReactionAdd increments the count of the reaction on the message, and tracks the user if Options.TrackReactionUsers is set
+// Reactions to messages not in state are ignored
+func (w *shardWorker) ReactionAdd(txn Txn, r *discordgo.MessageReaction) error {
+	if txn == nil {
+		return w.update(func(txn Txn) error {
+			return w.ReactionAdd(txn, r)
+		})
+	}
+
+	msg, item, err := w.channelMessageItem(txn, r.ChannelID, r.MessageID)
+	if err != nil {
+		return err
+	}
+
+	if msg == nil {
+		return nil
+	}
+
+	emoji := r.Emoji.APIName()
+	if w.State.opts.TrackReactionUsers {
+		userKey := KeyMessageReaction(r.ChannelID, r.MessageID, emoji, r.UserID)
+		_, err = txn.Get(userKey)
+		if err == nil {
+			// Already tracked, this can happen if the event is replayed on resume
+			return nil
+		} else if err != ErrNotFound {
+			return err
+		}
+
+		err = setRawEntry(txn, userKey, []byte{}, 0, item.ExpiresAt())
+		if err != nil {
+			return err
+		}
+	}
+
+	old := w.copyMessageForChange(msg)
+
+	me := w.isSelfUser(r.UserID)
+	found := false
+	for _, v := range msg.Reactions {
+		if v.Emoji != nil && v.Emoji.APIName() == emoji {
+			v.Count++
+			if me {
+				v.Me = true
+			}
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		emojiCop := r.Emoji
+		msg.Reactions = append(msg.Reactions, &discordgo.MessageReactions{
+			Count: 1,
+			Me:    me,
+			Emoji: &emojiCop,
+		})
+	}
+
+	return w.setReactionMessage(txn, msg, old, item)
+}
+
+// ReactionRemove decrements the count of the reaction on the message, and removes the user if Options.TrackReactionUsers is set
+func (w *shardWorker) ReactionRemove(txn Txn, r *discordgo.MessageReaction) error {
+	if txn == nil {
+		return w.update(func(txn Txn) error {
+			return w.ReactionRemove(txn, r)
+		})
+	}
+
+	msg, item, err := w.channelMessageItem(txn, r.ChannelID, r.MessageID)
+	if err != nil {
+		return err
+	}
+
+	if msg == nil {
+		return nil
+	}
+
+	emoji := r.Emoji.APIName()
+	if w.State.opts.TrackReactionUsers {
+		userKey := KeyMessageReaction(r.ChannelID, r.MessageID, emoji, r.UserID)
+		_, err = txn.Get(userKey)
+		if err == ErrNotFound {
+			// Already removed
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = txn.Delete(userKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	old := w.copyMessageForChange(msg)
+
+	for i, v := range msg.Reactions {
+		if v.Emoji == nil || v.Emoji.APIName() != emoji {
+			continue
+		}
+
+		v.Count--
+		if w.isSelfUser(r.UserID) {
+			v.Me = false
+		}
+
+		if v.Count <= 0 {
+			msg.Reactions = append(msg.Reactions[:i], msg.Reactions[i+1:]...)
+		}
+		break
+	}
+
+	return w.setReactionMessage(txn, msg, old, item)
+}
+
+// ReactionRemoveAll removes all the reactions from a message
+func (w *shardWorker) ReactionRemoveAll(txn Txn, channelID, messageID string) error {
+	if txn == nil {
+		return w.update(func(txn Txn) error {
+			return w.ReactionRemoveAll(txn, channelID, messageID)
+		})
+	}
+
+	if w.State.opts.TrackReactionUsers {
+		err := deleteKeysWithPrefix(txn, KeyMessageReactionsIteratorPrefix(channelID, messageID))
+		if err != nil {
+			return err
+		}
+	}
+
+	msg, item, err := w.channelMessageItem(txn, channelID, messageID)
+	if err != nil || msg == nil || len(msg.Reactions) < 1 {
+		return err
+	}
+
+	old := w.copyMessageForChange(msg)
+	msg.Reactions = nil
+
+	return w.setReactionMessage(txn, msg, old, item)
+}
+
+// setReactionMessage stores the message with the updated reactions, keeping the expiry and flags of the message
+func (w *shardWorker) setReactionMessage(txn Txn, msg, old *discordgo.Message, item Item) error {
+	encoded, err := w.State.encodeData(w.buffer, w.encoder, msg)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		w.addChange(&MessageChange{
+			GuildID:   w.messageGuildID(txn, msg),
+			ChannelID: msg.ChannelID,
+			MessageID: msg.ID,
+			Old:       old,
+			New:       msg,
+		})
+	}
+
+	return setRawEntry(txn, KeyChannelMessage(msg.ChannelID, msg.ID), encoded, item.UserMeta(), item.ExpiresAt())
+}
+
+// copyMessageForChange returns a copy of the message to be used as the old message in a change, nil if changes are not tracked
+// the reactions are copied aswell since they're modified in place
+func (w *shardWorker) copyMessageForChange(msg *discordgo.Message) *discordgo.Message {
+	if !w.trackChanges() {
+		return nil
+	}
+
+	cop := *msg
+	cop.Reactions = make([]*discordgo.MessageReactions, len(msg.Reactions))
+	for i, v := range msg.Reactions {
+		reactionCop := *v
+		cop.Reactions[i] = &reactionCop
+	}
+
+	return &cop
+}
+
+func (w *shardWorker) isSelfUser(userID string) bool {
+	w.State.memoryState.RLock()
+	defer w.State.memoryState.RUnlock()
+
+	return w.State.memoryState.User != nil && w.State.memoryState.User.ID == userID
+}
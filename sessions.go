@@ -0,0 +1,107 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sync/atomic"
+)
+
+// ShardSession is the gateway session of a shard, with it a shard can RESUME instead of identifying again after a restart
+// if the state was kept (see Options.KeepStateOnStart)
+type ShardSession struct {
+	ShardID    int
+	ShardCount int
+	SessionID  string
+
+	// Sequence number of the last event handled by the state
+	Sequence int64
+}
+
+// ShardSession returns the current gateway session of a shard
+//
+// After a start with Options.KeepStateOnStart where the previous shutdown was clean, this is the session from the previous run
+// until a new Ready is received, use it to RESUME the shard
+// Returns ErrNotFound if there's no session for this shard
+func (s *State) ShardSession(shardID int) (*ShardSession, error) {
+	if shardID >= s.numShards || shardID < 0 {
+		return nil, ErrNotFound
+	}
+
+	w := s.shards[shardID]
+	w.sessionMU.Lock()
+	sessionID := w.sessionID
+	w.sessionMU.Unlock()
+
+	if sessionID == "" {
+		return nil, ErrNotFound
+	}
+
+	return &ShardSession{
+		ShardID:    shardID,
+		ShardCount: s.numShards,
+		SessionID:  sessionID,
+		Sequence:   atomic.LoadInt64(&w.sequence),
+	}, nil
+}
+
+// PreviousShutdownClean returns true if the state was closed cleanly the last time the database was used
+// The state from the previous run is only kept if this is true, see Options.KeepStateOnStart
+func (s *State) PreviousShutdownClean() bool {
+	return s.previousShutdownClean
+}
+
+// trackSequence keeps track of the sequence number of the last event received on a shard
+func (s *State) trackSequence(shardID int, evt *discordgo.Event) {
+	if shardID >= s.numShards || evt.Sequence == 0 {
+		return
+	}
+
+	atomic.StoreInt64(&s.shards[shardID].sequence, evt.Sequence)
+}
+
+// saveShardSessions stores the current session of all the shards
+func (s *State) saveShardSessions() error {
+	return s.RetryUpdate(func(txn Txn) error {
+		for i := range s.shards {
+			session, err := s.ShardSession(i)
+			if err != nil {
+				if err == ErrNotFound {
+					continue
+				}
+
+				return err
+			}
+
+			err = s.SetKey(txn, nil, nil, KeyShardSession(i), session)
+			if err != nil {
+				return errors.WithMessage(err, "SetKey")
+			}
+		}
+
+		return nil
+	})
+}
+
+// loadShardSessions loads the shard sessions stored by the previous run, ignoring them if the shard count changed
+func (s *State) loadShardSessions() error {
+	for i, w := range s.shards {
+		var session *ShardSession
+		_, err := s.GetKey(nil, KeyShardSession(i), &session)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+
+			return err
+		}
+
+		if session.ShardCount != s.numShards {
+			continue
+		}
+
+		w.sessionID = session.SessionID
+		w.sequence = session.Sequence
+	}
+
+	return nil
+}
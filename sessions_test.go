@@ -0,0 +1,79 @@
+package dbstate
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeepStateOnStart(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_keep_state")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		DBOpts:           RecommendedBadgerOptions(dir),
+		KeepStateOnStart: true,
+		TrackChannels:    true,
+	}
+
+	state, err := NewState(1, opts)
+	AssertFatal(t, err, "failed creating state")
+
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.Ready{SessionID: "abc", User: &discordgo.User{ID: "1"}}), "failed handling ready")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.Event{Sequence: 1}), "failed handling event")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "10", Name: "kept"}}), "failed handling guild create")
+	AssertFatal(t, state.HandleEventNoSync(0, &discordgo.Event{Sequence: 2}), "failed handling event")
+	state.Close()
+
+	// The store is closed, nothing should be written to it
+	if err = state.HandleEventNoSync(0, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "11"}}); err != ErrStateClosed {
+		t.Error("expected ErrStateClosed after closing, got: ", err)
+	}
+	if err = state.HandleEventMutexSynced(0, &discordgo.Event{Sequence: 3}); err != ErrStateClosed {
+		t.Error("expected ErrStateClosed for a raw event after closing, got: ", err)
+	}
+
+	state, err = NewState(1, opts)
+	AssertFatal(t, err, "failed reopening state")
+
+	if !state.PreviousShutdownClean() {
+		t.Error("previous shutdown not marked as clean")
+	}
+
+	session, err := state.ShardSession(0)
+	AssertFatal(t, err, "failed retrieving shard session")
+	if session.SessionID != "abc" || session.Sequence != 2 {
+		t.Errorf("unexpected session: %#v", session)
+	}
+
+	g, err := state.Guild("10")
+	AssertFatal(t, err, "failed retrieving kept guild")
+	if g.Name != "kept" {
+		t.Errorf("unexpected guild name: %q", g.Name)
+	}
+
+	if u := state.SelfUser(); u == nil || u.ID != "1" {
+		t.Errorf("unexpected self user: %#v", u)
+	}
+
+	// Simulate a crash by closing the store directly
+	state.Store.Close()
+
+	state, err = NewState(1, opts)
+	AssertFatal(t, err, "failed reopening state after unclean shutdown")
+	defer state.Close()
+
+	if state.PreviousShutdownClean() {
+		t.Error("previous shutdown marked as clean")
+	}
+
+	if _, err := state.Guild("10"); !IsNotFound(err) {
+		t.Error("state kept after unclean shutdown, err: ", err)
+	}
+
+	if _, err := state.ShardSession(0); !IsNotFound(err) {
+		t.Error("shard session kept after unclean shutdown, err: ", err)
+	}
+}
@@ -0,0 +1,284 @@
+package dbstate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// The snapshot stream starts with snapshotMagic followed by the snapshot format version (uvarint)
+// and the length prefixed json encoded MetaInfo of the database.
+//
+// After that come the records, each record is:
+// key length (uvarint), key, value length (uvarint), value, user meta (1 byte), expires at (uvarint)
+// The stream ends with a record with a key length of 0
+const (
+	snapshotMagic   = "DBSTATESNAP"
+	SnapshotVersion = 1
+
+	// Number of keys restored per transaction
+	restoreBatchSize = 1000
+)
+
+var (
+	// Returned by Restore if the stream does not start with the snapshot header
+	ErrInvalidSnapshot = errors.New("Not a valid snapshot")
+
+	// Returned by Restore if the snapshot was created with a different SnapshotVersion
+	ErrDifferentSnapshotVersion = errors.New("Snapshot was created with a different snapshot format version")
+
+	// Returned by Restore if a key or value is larger than what could reasonably be in state, meaning the snapshot is most likely corrupt
+	ErrSnapshotRecordTooBig = errors.New("Snapshot record is too big")
+)
+
+const maxSnapshotRecordSize = 64 << 20
+
+// Snapshot writes a consistent snapshot of the whole state to w, the shard sessions are not included
+// It's done in a single read only transaction so it can be done while the state is being updated
+func (s *State) Snapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	err := s.Store.View(func(txn Txn) error {
+		meta, err := s.getMeta(txn)
+		if err != nil {
+			return errors.WithMessage(err, "getMeta")
+		}
+
+		encodedMeta, err := jsoniter.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		buf := make([]byte, binary.MaxVarintLen64)
+
+		bw.WriteString(snapshotMagic)
+		bw.Write(buf[:binary.PutUvarint(buf, SnapshotVersion)])
+		bw.Write(buf[:binary.PutUvarint(buf, uint64(len(encodedMeta)))])
+		bw.Write(encodedMeta)
+
+		it := txn.NewIterator(DefaultIteratorOptions)
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			if bytes.Equal(key, KeyMeta) || key[0] == byte(KeyTypeShardSession) {
+				continue
+			}
+
+			v, err := item.Value()
+			if err != nil {
+				return err
+			}
+
+			bw.Write(buf[:binary.PutUvarint(buf, uint64(len(key)))])
+			bw.Write(key)
+			bw.Write(buf[:binary.PutUvarint(buf, uint64(len(v)))])
+			bw.Write(v)
+			bw.WriteByte(item.UserMeta())
+			_, err = bw.Write(buf[:binary.PutUvarint(buf, item.ExpiresAt())])
+			if err != nil {
+				return err
+			}
+		}
+
+		// End
+		return bw.WriteByte(0)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Restore restores a snapshot created with Snapshot, if keyTypes is provided only keys of those types are restored,
+// along with the indexes and other key types derived from them (see derivedKeyTypes)
+// Keys in the snapshot overwrite the existing ones, but the other keys in the state are left alone
+// The snapshot has to be created by a database with the same FormatVersion and codec as this one
+func (s *State) Restore(r io.Reader, keyTypes ...KeyType) error {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(snapshotMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic) != snapshotMagic {
+		return ErrInvalidSnapshot
+	}
+
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errors.WithMessage(err, "ReadVersion")
+	}
+
+	if version != SnapshotVersion {
+		return ErrDifferentSnapshotVersion
+	}
+
+	encodedMeta, err := readSnapshotBytes(br)
+	if err != nil {
+		return errors.WithMessage(err, "ReadMeta")
+	}
+
+	var meta *MetaInfo
+	err = jsoniter.Unmarshal(encodedMeta, &meta)
+	if err != nil {
+		return errors.WithMessage(err, "DecodeMeta")
+	}
+
+	if meta.FormatVersion != FormatVersion {
+		return errors.WithMessage(ErrDifferentFormatVersion, fmt.Sprintf("snapshot: v%d", meta.FormatVersion))
+	}
+
+	if meta.Codec == "" {
+		meta.Codec = (&JSONCodec{}).Name()
+	}
+
+	if meta.Codec != s.opts.Codec.Name() {
+		return errors.WithMessage(ErrDifferentCodec, fmt.Sprintf("snapshot: %q, options: %q", meta.Codec, s.opts.Codec.Name()))
+	}
+
+	keyTypes = withDerivedKeyTypes(keyTypes)
+
+	restored := 0
+	done := false
+	for !done {
+		entries := make([]*MigrationEntry, 0, restoreBatchSize)
+		for len(entries) < restoreBatchSize {
+			e, err := readSnapshotRecord(br)
+			if err != nil {
+				return errors.WithMessage(err, "ReadRecord")
+			}
+
+			if e == nil {
+				done = true
+				break
+			}
+
+			if !snapshotIncludeKey(e.Key, keyTypes) {
+				continue
+			}
+
+			entries = append(entries, e)
+		}
+
+		err = s.RetryUpdate(func(txn Txn) error {
+			for _, e := range entries {
+				err := setRawEntry(txn, e.Key, e.Value, e.UserMeta, e.ExpiresAt)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		restored += len(entries)
+	}
+
+	s.opts.Logger.LogInfo(fmt.Sprintf("Restored %d keys from snapshot", restored))
+	return nil
+}
+
+// derivedKeyTypes are the key types that are derived from or belong to another key type, and have to be restored along with it
+var derivedKeyTypes = map[KeyType][]KeyType{
+	KeyTypeGuild:          {KeyTypeGuildRole, KeyTypeGuildEmoji, KeyTypeGuildChannel, KeyTypeGuildUnavailable},
+	KeyTypeMember:         {KeyTypeMemberName, KeyTypeRoleMember, KeyTypeMemberLoadProgress},
+	KeyTypeChannel:        {KeyTypeDMChannel, KeyTypeUserDMChannel},
+	KeyTypeChannelMessage: {KeyTypeMessageReaction, KeyTypeGuildUserMessage, KeyTypeChannelUserMessage},
+	KeyTypeVoiceState:     {KeyTypeVoiceChannelMember},
+}
+
+// withDerivedKeyTypes returns keyTypes with the key types derived from them added
+func withDerivedKeyTypes(keyTypes []KeyType) []KeyType {
+	result := append([]KeyType(nil), keyTypes...)
+	for _, t := range keyTypes {
+		for _, derived := range derivedKeyTypes[t] {
+			if !containsKeyType(result, derived) {
+				result = append(result, derived)
+			}
+		}
+	}
+
+	return result
+}
+
+func containsKeyType(keyTypes []KeyType, t KeyType) bool {
+	for _, v := range keyTypes {
+		if v == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+func snapshotIncludeKey(key []byte, keyTypes []KeyType) bool {
+	if len(keyTypes) < 1 {
+		return true
+	}
+
+	for _, v := range keyTypes {
+		if key[0] == byte(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readSnapshotRecord reads a single record, returning nil at the end of the snapshot
+func readSnapshotRecord(br *bufio.Reader) (*MigrationEntry, error) {
+	key, err := readSnapshotBytes(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	value, err := readSnapshotBytes(br)
+	if err != nil {
+		return nil, err
+	}
+
+	userMeta, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MigrationEntry{
+		Key:       key,
+		Value:     value,
+		UserMeta:  userMeta,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// readSnapshotBytes reads a length prefixed byte slice
+func readSnapshotBytes(br *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if l > maxSnapshotRecordSize {
+		return nil, ErrSnapshotRecordTooBig
+	}
+
+	b := make([]byte, l)
+	_, err = io.ReadFull(br, b)
+	return b, err
+}
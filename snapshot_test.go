@@ -0,0 +1,96 @@
+package dbstate
+
+import (
+	"bytes"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	src, err := NewState(1, Options{Store: NewMemoryStore(), TrackMembers: true, TrackMessages: true, TrackReactionUsers: true})
+	AssertFatal(t, err, "failed creating source state")
+	defer src.Close()
+
+	events := []interface{}{
+		&discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1", Name: "snapshotted", MemberCount: 1, Members: []*discordgo.Member{{User: &discordgo.User{ID: "2"}, Nick: "nick"}}}},
+		&discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "3", Unavailable: true}},
+		&discordgo.MessageCreate{Message: &discordgo.Message{ID: "20", ChannelID: "10", GuildID: "1", Author: &discordgo.User{ID: "2"}}},
+		&discordgo.MessageReactionAdd{MessageReaction: &discordgo.MessageReaction{UserID: "2", MessageID: "20", ChannelID: "10", GuildID: "1", Emoji: discordgo.Emoji{Name: "a"}}},
+	}
+
+	for _, v := range events {
+		AssertFatal(t, src.HandleEventNoSync(0, v), "failed handling event")
+	}
+
+	var buf bytes.Buffer
+	AssertFatal(t, src.Snapshot(&buf), "failed creating snapshot")
+	snapshot := buf.Bytes()
+
+	dst, err := NewState(1, Options{Store: NewMemoryStore()})
+	AssertFatal(t, err, "failed creating destination state")
+	defer dst.Close()
+
+	// Only restore members
+	AssertFatal(t, dst.Restore(bytes.NewReader(snapshot), KeyTypeMember), "failed restoring snapshot")
+
+	m, err := dst.GuildMember("1", "2")
+	AssertFatal(t, err, "failed retrieving restored member")
+	if m.Nick != "nick" {
+		t.Errorf("unexpected nick on restored member: %q", m.Nick)
+	}
+
+	// The member indexes should be restored with the members
+	members, err := dst.SearchGuildMembers("1", "nic", 0)
+	AssertFatal(t, err, "failed searching restored members")
+	if len(members) != 1 || members[0].User.ID != "2" {
+		t.Errorf("unexpected search results after restoring members: %d", len(members))
+	}
+
+	if _, err := dst.Guild("1"); !IsNotFound(err) {
+		t.Error("guild restored even though only members were selected, err: ", err)
+	}
+
+	// The load progress belongs to the members, otherwise member removals would change the member count again
+	if !dst.GuildMembersLoaded("1") {
+		t.Error("member load progress not restored with the members")
+	}
+
+	// Only restore messages, the reactions belong to them
+	AssertFatal(t, dst.Restore(bytes.NewReader(snapshot), KeyTypeChannelMessage), "failed restoring snapshot")
+	users, err := dst.MessageReactionUsers("10", "20", "a")
+	AssertFatal(t, err, "failed retrieving reaction users")
+	if len(users) != 1 || users[0] != "2" {
+		t.Errorf("unexpected reaction users after restoring messages: %v", users)
+	}
+
+	// Only restore guilds, the unavailable guilds should be included
+	AssertFatal(t, dst.Restore(bytes.NewReader(snapshot), KeyTypeGuild), "failed restoring snapshot")
+	unavailable, err := dst.UnavailableGuilds()
+	AssertFatal(t, err, "failed retrieving unavailable guilds")
+	if len(unavailable) != 1 || unavailable[0] != "3" {
+		t.Errorf("unexpected unavailable guilds after restoring guilds: %v", unavailable)
+	}
+
+	// Restore everything
+	AssertFatal(t, dst.Restore(bytes.NewReader(snapshot)), "failed restoring full snapshot")
+	g, err := dst.Guild("1")
+	AssertFatal(t, err, "failed retrieving restored guild")
+	if g.Name != "snapshotted" {
+		t.Errorf("unexpected name on restored guild: %q", g.Name)
+	}
+
+	// Mismatched format version
+	AssertFatal(t, src.setMeta(nil, &MetaInfo{FormatVersion: FormatVersion - 1}), "failed setting meta")
+	buf.Reset()
+	AssertFatal(t, src.Snapshot(&buf), "failed creating snapshot")
+
+	err = dst.Restore(&buf)
+	if errors.Cause(err) != ErrDifferentFormatVersion {
+		t.Error("expected ErrDifferentFormatVersion, got: ", err)
+	}
+
+	if err := dst.Restore(bytes.NewReader([]byte("garbage"))); err != ErrInvalidSnapshot {
+		t.Error("expected ErrInvalidSnapshot, got: ", err)
+	}
+}
@@ -0,0 +1,87 @@
+package dbstate
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	// Returned by Store.Update if the transaction conflicted with another one, RetryUpdate will retry on this
+	ErrConflict = errors.New("Transaction conflict")
+)
+
+// Store is the ordered key value store backing the state
+//
+// Keys are sorted lexicographically, and transactions should be isolated from eachother
+// (View transactions in particular need to see a consistent snapshot, as migrations and snapshots rely on this)
+//
+// BadgerStore is the default Store, BoltStore can be used where running badger's value log isn't an option
+// and MemoryStore keeps everything in memory, for tests and small bots
+type Store interface {
+	// View runs fn inside a read only transaction
+	View(fn func(txn Txn) error) error
+
+	// Update runs fn inside a read write transaction, which is committed if fn returns nil
+	// Returns ErrConflict if the transaction conflicted with another one
+	Update(fn func(txn Txn) error) error
+
+	// RunGC is called every minute, giving the store a chance to clean up (e.g remove expired keys)
+	RunGC() error
+
+	Close() error
+}
+
+// Txn is a transaction in a Store
+type Txn interface {
+	// Get returns ErrNotFound if the key does not exist or has expired
+	Get(key []byte) (Item, error)
+
+	Set(key, val []byte) error
+	SetWithMeta(key, val []byte, meta byte) error
+	SetWithTTL(key, val []byte, ttl time.Duration) error
+	SetWithMetaTTL(key, val []byte, meta byte, ttl time.Duration) error
+	Delete(key []byte) error
+
+	NewIterator(opts IteratorOptions) Iterator
+}
+
+// Item is a single key value pair, it's only valid for the duration of the transaction
+type Item interface {
+	Key() []byte
+
+	// Value returns the value, it's only valid until the transaction is done or the iterator it came from moves on
+	Value() ([]byte, error)
+
+	// ValueCopy copies the value into dst (if it has enough capacity) and returns it
+	ValueCopy(dst []byte) ([]byte, error)
+
+	UserMeta() byte
+
+	// ExpiresAt returns the unix time in seconds the item expires at, or 0 if it does not expire
+	ExpiresAt() uint64
+}
+
+// IteratorOptions are the options passed to Txn.NewIterator
+type IteratorOptions struct {
+	// Wether values will be read (stores may use this as a hint to skip reading them)
+	PrefetchValues bool
+
+	// Iterate in reverse, Seek will seek to the last key lower than or equal to the one provided
+	Reverse bool
+}
+
+// DefaultIteratorOptions are the default options, iterating forwards and fetching values
+var DefaultIteratorOptions = IteratorOptions{
+	PrefetchValues: true,
+}
+
+// Iterator iterates over the keys in a Store, expired keys are skipped
+type Iterator interface {
+	Rewind()
+	Seek(key []byte)
+	Valid() bool
+	ValidForPrefix(prefix []byte) bool
+	Next()
+	Item() Item
+	Close()
+}
@@ -0,0 +1,110 @@
+package dbstate
+
+import (
+	"github.com/dgraph-io/badger"
+	"time"
+)
+
+// BadgerStore is the default Store, backed by badger
+type BadgerStore struct {
+	DB *badger.DB
+}
+
+var _ Store = (*BadgerStore)(nil)
+
+// OpenBadgerStore opens a badger db with the provided options
+func OpenBadgerStore(opts *badger.Options) (*BadgerStore, error) {
+	db, err := badger.Open(*opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BadgerStore{DB: db}, nil
+}
+
+func (b *BadgerStore) View(fn func(txn Txn) error) error {
+	return b.DB.View(func(txn *badger.Txn) error {
+		return fn(&badgerTxn{txn: txn})
+	})
+}
+
+func (b *BadgerStore) Update(fn func(txn Txn) error) error {
+	err := b.DB.Update(func(txn *badger.Txn) error {
+		return fn(&badgerTxn{txn: txn})
+	})
+
+	if err == badger.ErrConflict {
+		return ErrConflict
+	}
+
+	return err
+}
+
+func (b *BadgerStore) RunGC() error {
+	// Enabling this made all the keys suddenly stop working, I think I may be doing something wrong in this regard.
+	// db.PurgeOlderVersions()
+
+	return b.DB.RunValueLogGC(0.5)
+}
+
+func (b *BadgerStore) Close() error {
+	return b.DB.Close()
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t *badgerTxn) Get(key []byte) (Item, error) {
+	item, err := t.txn.Get(key)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (t *badgerTxn) Set(key, val []byte) error {
+	return t.txn.Set(key, val)
+}
+
+func (t *badgerTxn) SetWithMeta(key, val []byte, meta byte) error {
+	return t.txn.SetWithMeta(key, val, meta)
+}
+
+func (t *badgerTxn) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	return t.txn.SetWithTTL(key, val, ttl)
+}
+
+func (t *badgerTxn) SetWithMetaTTL(key, val []byte, meta byte, ttl time.Duration) error {
+	return t.txn.SetEntry(&badger.Entry{
+		Key:       key,
+		Value:     val,
+		UserMeta:  meta,
+		ExpiresAt: uint64(time.Now().Add(ttl).Unix()),
+	})
+}
+
+func (t *badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t *badgerTxn) NewIterator(opts IteratorOptions) Iterator {
+	bOpts := badger.DefaultIteratorOptions
+	bOpts.PrefetchValues = opts.PrefetchValues
+	bOpts.Reverse = opts.Reverse
+
+	return &badgerIterator{Iterator: t.txn.NewIterator(bOpts)}
+}
+
+type badgerIterator struct {
+	*badger.Iterator
+}
+
+func (it *badgerIterator) Item() Item {
+	return it.Iterator.Item()
+}
@@ -0,0 +1,268 @@
+package dbstate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go.etcd.io/bbolt"
+	"os"
+	"time"
+)
+
+// All keys are stored in this bucket
+var boltBucket = []byte("dbstate")
+
+// BoltStore is a Store backed by bbolt, for when running badger's value log isn't an option
+//
+// bbolt has no concept of ttl's or user meta, so they're stored in front of the values:
+// 1 byte user meta, 8 bytes expires at (unix seconds, 0 if it never expires), then the value
+// Expired keys are skipped when reading and removed by RunGC
+type BoltStore struct {
+	DB *bbolt.DB
+}
+
+var _ Store = (*BoltStore)(nil)
+
+// OpenBoltStore opens or creates a bbolt db at path
+func OpenBoltStore(path string, opts *bbolt.Options) (*BoltStore, error) {
+	db, err := bbolt.Open(path, os.ModePerm, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{DB: db}, nil
+}
+
+func (b *BoltStore) View(fn func(txn Txn) error) error {
+	return b.DB.View(func(tx *bbolt.Tx) error {
+		return fn(&boltTxn{bucket: tx.Bucket(boltBucket), now: uint64(time.Now().Unix())})
+	})
+}
+
+// Update runs fn in a read write transaction, there can only be one of these at a time in bbolt so it will never return ErrConflict
+func (b *BoltStore) Update(fn func(txn Txn) error) error {
+	return b.DB.Update(func(tx *bbolt.Tx) error {
+		return fn(&boltTxn{bucket: tx.Bucket(boltBucket), now: uint64(time.Now().Unix())})
+	})
+}
+
+// RunGC removes expired keys, using multiple transactions to avoid holding the write lock for too long
+func (b *BoltStore) RunGC() error {
+	var cur []byte
+	for {
+		done := true
+		err := b.DB.Update(func(tx *bbolt.Tx) error {
+			now := uint64(time.Now().Unix())
+			bucket := tx.Bucket(boltBucket)
+
+			expired := make([][]byte, 0, 1000)
+			c := bucket.Cursor()
+			for k, v := c.Seek(cur); k != nil; k, v = c.Next() {
+				if len(expired) >= 1000 {
+					done = false
+					cur = append([]byte{}, k...)
+					break
+				}
+
+				if boltExpired(v, now) {
+					expired = append(expired, append([]byte{}, k...))
+				}
+			}
+
+			for _, k := range expired {
+				err := bucket.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func (b *BoltStore) Close() error {
+	return b.DB.Close()
+}
+
+func boltExpired(raw []byte, now uint64) bool {
+	expiresAt := binary.BigEndian.Uint64(raw[1:9])
+	return expiresAt != 0 && expiresAt <= now
+}
+
+type boltTxn struct {
+	bucket *bbolt.Bucket
+	now    uint64
+}
+
+func (t *boltTxn) Get(key []byte) (Item, error) {
+	raw := t.bucket.Get(key)
+	if raw == nil || boltExpired(raw, t.now) {
+		return nil, ErrNotFound
+	}
+
+	return &boltItem{key: key, raw: raw}, nil
+}
+
+func (t *boltTxn) set(key, val []byte, meta byte, expiresAt uint64) error {
+	// bbolt requires the key and value to be valid for the lifetime of the transaction
+	raw := make([]byte, len(val)+9)
+	raw[0] = meta
+	binary.BigEndian.PutUint64(raw[1:], expiresAt)
+	copy(raw[9:], val)
+
+	return t.bucket.Put(append([]byte{}, key...), raw)
+}
+
+func (t *boltTxn) Set(key, val []byte) error {
+	return t.set(key, val, 0, 0)
+}
+
+func (t *boltTxn) SetWithMeta(key, val []byte, meta byte) error {
+	return t.set(key, val, meta, 0)
+}
+
+func (t *boltTxn) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	return t.set(key, val, 0, uint64(time.Now().Add(ttl).Unix()))
+}
+
+func (t *boltTxn) SetWithMetaTTL(key, val []byte, meta byte, ttl time.Duration) error {
+	return t.set(key, val, meta, uint64(time.Now().Add(ttl).Unix()))
+}
+
+func (t *boltTxn) Delete(key []byte) error {
+	return t.bucket.Delete(key)
+}
+
+func (t *boltTxn) NewIterator(opts IteratorOptions) Iterator {
+	return &boltIterator{
+		txn:     t,
+		cursor:  t.bucket.Cursor(),
+		reverse: opts.Reverse,
+	}
+}
+
+type boltItem struct {
+	key []byte
+	raw []byte
+}
+
+func (i *boltItem) Key() []byte {
+	return i.key
+}
+
+func (i *boltItem) Value() ([]byte, error) {
+	return i.raw[9:], nil
+}
+
+func (i *boltItem) ValueCopy(dst []byte) ([]byte, error) {
+	return append(dst[:0], i.raw[9:]...), nil
+}
+
+func (i *boltItem) UserMeta() byte {
+	return i.raw[0]
+}
+
+func (i *boltItem) ExpiresAt() uint64 {
+	return binary.BigEndian.Uint64(i.raw[1:9])
+}
+
+// boltIterator wraps a bbolt cursor
+// bbolt cursors may be invalidated by writes in the same transaction, so it re-seeks to the current key on every step
+type boltIterator struct {
+	txn     *boltTxn
+	cursor  *bbolt.Cursor
+	reverse bool
+
+	key []byte
+	raw []byte
+}
+
+func (it *boltIterator) Rewind() {
+	if it.reverse {
+		it.settle(it.cursor.Last())
+	} else {
+		it.settle(it.cursor.First())
+	}
+}
+
+func (it *boltIterator) Seek(key []byte) {
+	k, v := it.cursor.Seek(key)
+	if it.reverse {
+		if k == nil {
+			k, v = it.cursor.Last()
+		} else if bytes.Compare(k, key) > 0 {
+			k, v = it.cursor.Prev()
+		}
+	}
+
+	it.settle(k, v)
+}
+
+func (it *boltIterator) Next() {
+	if it.key == nil {
+		return
+	}
+
+	k, v := it.cursor.Seek(it.key)
+	if it.reverse {
+		if k == nil {
+			k, v = it.cursor.Last()
+			if k != nil && bytes.Equal(k, it.key) {
+				k, v = it.cursor.Prev()
+			}
+		} else {
+			k, v = it.cursor.Prev()
+		}
+	} else if k != nil && bytes.Equal(k, it.key) {
+		k, v = it.cursor.Next()
+	}
+
+	it.settle(k, v)
+}
+
+// settle moves past expired keys and stores the current position
+func (it *boltIterator) settle(k, v []byte) {
+	for k != nil && boltExpired(v, it.txn.now) {
+		if it.reverse {
+			k, v = it.cursor.Prev()
+		} else {
+			k, v = it.cursor.Next()
+		}
+	}
+
+	if k == nil {
+		it.key = nil
+		it.raw = nil
+		return
+	}
+
+	it.key = append(it.key[:0], k...)
+	it.raw = v
+}
+
+func (it *boltIterator) Valid() bool {
+	return it.key != nil
+}
+
+func (it *boltIterator) ValidForPrefix(prefix []byte) bool {
+	return it.key != nil && bytes.HasPrefix(it.key, prefix)
+}
+
+func (it *boltIterator) Item() Item {
+	return &boltItem{key: it.key, raw: it.raw}
+}
+
+func (it *boltIterator) Close() {}
@@ -0,0 +1,384 @@
+package dbstate
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var errReadOnlyTxn = errors.New("Sets or deletes are not allowed in a read only transaction")
+
+// MemoryStore is a Store that keeps everything in memory, useful for tests and small bots
+//
+// The keys are kept in an immutable treap, every write copies the path down to the changed node.
+// This means that transactions are just a pointer to a root and always see a consistent snapshot,
+// update transactions are ran one at a time so they will never conflict.
+// Expired keys are skipped when reading and removed by RunGC
+type MemoryStore struct {
+	// Held for the duration of update transactions
+	updateMU sync.Mutex
+
+	mu   sync.RWMutex
+	root *memNode
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns a new empty in memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (m *MemoryStore) currentRoot() *memNode {
+	m.mu.RLock()
+	root := m.root
+	m.mu.RUnlock()
+	return root
+}
+
+func (m *MemoryStore) View(fn func(txn Txn) error) error {
+	return fn(&memoryTxn{root: m.currentRoot(), now: uint64(time.Now().Unix())})
+}
+
+func (m *MemoryStore) Update(fn func(txn Txn) error) error {
+	m.updateMU.Lock()
+	defer m.updateMU.Unlock()
+
+	txn := &memoryTxn{root: m.currentRoot(), now: uint64(time.Now().Unix()), update: true}
+	err := fn(txn)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.root = txn.root
+	m.mu.Unlock()
+	return nil
+}
+
+// RunGC removes expired keys
+func (m *MemoryStore) RunGC() error {
+	return m.Update(func(txn Txn) error {
+		mTxn := txn.(*memoryTxn)
+
+		expired := make([][]byte, 0)
+		it := newMemIterator(mTxn.root, 0, false)
+		for it.Rewind(); it.Valid(); it.Next() {
+			if it.Item().ExpiresAt() != 0 && it.Item().ExpiresAt() <= mTxn.now {
+				expired = append(expired, it.Item().Key())
+			}
+		}
+
+		for _, k := range expired {
+			mTxn.root, _ = memDelete(mTxn.root, k)
+		}
+
+		return nil
+	})
+}
+
+func (m *MemoryStore) Close() error {
+	m.mu.Lock()
+	m.root = nil
+	m.mu.Unlock()
+	return nil
+}
+
+// memNode is a node in the treap, nodes are never modified after being added to a tree
+type memNode struct {
+	key       []byte
+	value     []byte
+	meta      byte
+	expiresAt uint64
+
+	priority    uint32
+	left, right *memNode
+}
+
+func (n *memNode) expired(now uint64) bool {
+	return n.expiresAt != 0 && n.expiresAt <= now
+}
+
+func (n *memNode) Key() []byte {
+	return n.key
+}
+
+func (n *memNode) Value() ([]byte, error) {
+	return n.value, nil
+}
+
+func (n *memNode) ValueCopy(dst []byte) ([]byte, error) {
+	return append(dst[:0], n.value...), nil
+}
+
+func (n *memNode) UserMeta() byte {
+	return n.meta
+}
+
+func (n *memNode) ExpiresAt() uint64 {
+	return n.expiresAt
+}
+
+func memGet(n *memNode, key []byte) *memNode {
+	for n != nil {
+		c := bytes.Compare(key, n.key)
+		if c == 0 {
+			return n
+		}
+
+		if c < 0 {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+
+	return nil
+}
+
+// memInsert returns a new root with e inserted, e replaces the node with the same key if there is one
+// all the nodes returned are either e or new copies, so they can be rotated in place
+func memInsert(n *memNode, e *memNode) *memNode {
+	if n == nil {
+		return e
+	}
+
+	c := bytes.Compare(e.key, n.key)
+	if c == 0 {
+		e.priority = n.priority
+		e.left = n.left
+		e.right = n.right
+		return e
+	}
+
+	cop := *n
+	if c < 0 {
+		cop.left = memInsert(n.left, e)
+		if cop.left.priority > cop.priority {
+			// Rotate right
+			l := cop.left
+			cop.left = l.right
+			l.right = &cop
+			return l
+		}
+	} else {
+		cop.right = memInsert(n.right, e)
+		if cop.right.priority > cop.priority {
+			// Rotate left
+			r := cop.right
+			cop.right = r.left
+			r.left = &cop
+			return r
+		}
+	}
+
+	return &cop
+}
+
+// memDelete returns a new root without key, and wether it was found
+func memDelete(n *memNode, key []byte) (*memNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	c := bytes.Compare(key, n.key)
+	if c == 0 {
+		return memMerge(n.left, n.right), true
+	}
+
+	cop := *n
+	var found bool
+	if c < 0 {
+		cop.left, found = memDelete(n.left, key)
+	} else {
+		cop.right, found = memDelete(n.right, key)
+	}
+
+	if !found {
+		return n, false
+	}
+
+	return &cop, true
+}
+
+// memMerge merges 2 trees where all the keys in a are lower than the ones in b
+func memMerge(a, b *memNode) *memNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+
+	if a.priority > b.priority {
+		cop := *a
+		cop.right = memMerge(a.right, b)
+		return &cop
+	}
+
+	cop := *b
+	cop.left = memMerge(a, b.left)
+	return &cop
+}
+
+type memoryTxn struct {
+	root   *memNode
+	now    uint64
+	update bool
+}
+
+func (t *memoryTxn) Get(key []byte) (Item, error) {
+	n := memGet(t.root, key)
+	if n == nil || n.expired(t.now) {
+		return nil, ErrNotFound
+	}
+
+	return n, nil
+}
+
+func (t *memoryTxn) set(key, val []byte, meta byte, expiresAt uint64) error {
+	if !t.update {
+		return errReadOnlyTxn
+	}
+
+	t.root = memInsert(t.root, &memNode{
+		key:       append([]byte{}, key...),
+		value:     append([]byte{}, val...),
+		meta:      meta,
+		expiresAt: expiresAt,
+		priority:  rand.Uint32(),
+	})
+	return nil
+}
+
+func (t *memoryTxn) Set(key, val []byte) error {
+	return t.set(key, val, 0, 0)
+}
+
+func (t *memoryTxn) SetWithMeta(key, val []byte, meta byte) error {
+	return t.set(key, val, meta, 0)
+}
+
+func (t *memoryTxn) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	return t.set(key, val, 0, uint64(time.Now().Add(ttl).Unix()))
+}
+
+func (t *memoryTxn) SetWithMetaTTL(key, val []byte, meta byte, ttl time.Duration) error {
+	return t.set(key, val, meta, uint64(time.Now().Add(ttl).Unix()))
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if !t.update {
+		return errReadOnlyTxn
+	}
+
+	t.root, _ = memDelete(t.root, key)
+	return nil
+}
+
+// NewIterator returns a new iterator over the keys in the transaction at the time of calling
+func (t *memoryTxn) NewIterator(opts IteratorOptions) Iterator {
+	return newMemIterator(t.root, t.now, opts.Reverse)
+}
+
+// memIterator iterates over a treap using a stack of the nodes left to visit
+type memIterator struct {
+	root    *memNode
+	now     uint64
+	reverse bool
+
+	stack []*memNode
+}
+
+func newMemIterator(root *memNode, now uint64, reverse bool) *memIterator {
+	return &memIterator{
+		root:    root,
+		now:     now,
+		reverse: reverse,
+	}
+}
+
+// push pushes n and the chain of nodes leading to the first node in its subtree in the direction of iteration
+func (it *memIterator) push(n *memNode) {
+	for n != nil {
+		it.stack = append(it.stack, n)
+		if it.reverse {
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+}
+
+func (it *memIterator) Rewind() {
+	it.stack = it.stack[:0]
+	it.push(it.root)
+	it.skipExpired()
+}
+
+func (it *memIterator) Seek(key []byte) {
+	it.stack = it.stack[:0]
+
+	n := it.root
+	for n != nil {
+		c := bytes.Compare(n.key, key)
+		if it.reverse {
+			if c <= 0 {
+				it.stack = append(it.stack, n)
+				n = n.right
+			} else {
+				n = n.left
+			}
+		} else {
+			if c >= 0 {
+				it.stack = append(it.stack, n)
+				n = n.left
+			} else {
+				n = n.right
+			}
+		}
+	}
+
+	it.skipExpired()
+}
+
+func (it *memIterator) next() {
+	n := it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	if it.reverse {
+		it.push(n.left)
+	} else {
+		it.push(n.right)
+	}
+}
+
+func (it *memIterator) skipExpired() {
+	for len(it.stack) > 0 && it.stack[len(it.stack)-1].expired(it.now) {
+		it.next()
+	}
+}
+
+func (it *memIterator) Next() {
+	if len(it.stack) < 1 {
+		return
+	}
+
+	it.next()
+	it.skipExpired()
+}
+
+func (it *memIterator) Valid() bool {
+	return len(it.stack) > 0
+}
+
+func (it *memIterator) ValidForPrefix(prefix []byte) bool {
+	return len(it.stack) > 0 && bytes.HasPrefix(it.stack[len(it.stack)-1].key, prefix)
+}
+
+func (it *memIterator) Item() Item {
+	return it.stack[len(it.stack)-1]
+}
+
+func (it *memIterator) Close() {}
@@ -0,0 +1,223 @@
+package dbstate
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBadgerStore(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "dbstate_test_badger_store")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	store, err := OpenBadgerStore(RecommendedBadgerOptions(dir))
+	AssertFatal(t, err, "failed opening badger store")
+	defer store.Close()
+
+	testStore(t, store)
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "dbstate_test_bolt_store.db")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	store, err := OpenBoltStore(path, nil)
+	AssertFatal(t, err, "failed opening bolt store")
+	defer store.Close()
+
+	testStore(t, store)
+	AssertErr(t, store.RunGC(), "failed running gc")
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	testStore(t, store)
+	AssertErr(t, store.RunGC(), "failed running gc")
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	store := NewMemoryStore()
+
+	err := store.View(func(txn Txn) error {
+		err := store.Update(func(txn Txn) error {
+			return txn.Set([]byte("a"), []byte("a"))
+		})
+		AssertFatal(t, err, "failed setting key")
+
+		if _, err := txn.Get([]byte("a")); err != ErrNotFound {
+			t.Error("key set after the transaction started is visible")
+		}
+		return nil
+	})
+	AssertFatal(t, err, "failed viewing")
+
+	err = store.View(func(txn Txn) error {
+		_, err := txn.Get([]byte("a"))
+		return err
+	})
+	AssertErr(t, err, "key not visible in new transaction")
+}
+
+func TestMemoryStoreRandom(t *testing.T) {
+	store := NewMemoryStore()
+	expected := make(map[string]bool)
+
+	err := store.Update(func(txn Txn) error {
+		for i := 0; i < 5000; i++ {
+			k := []byte{byte(rand.Intn(16)), byte(rand.Intn(256))}
+			if rand.Intn(3) == 0 {
+				delete(expected, string(k))
+				txn.Delete(k)
+			} else {
+				expected[string(k)] = true
+				txn.Set(k, k)
+			}
+		}
+		return nil
+	})
+	AssertFatal(t, err, "failed updating")
+
+	sorted := make([]string, 0, len(expected))
+	for k, _ := range expected {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	store.View(func(txn Txn) error {
+		i := 0
+		it := txn.NewIterator(DefaultIteratorOptions)
+		for it.Rewind(); it.Valid(); it.Next() {
+			if i >= len(sorted) || !bytes.Equal(it.Item().Key(), []byte(sorted[i])) {
+				t.Fatalf("unexpected key at %d: %v", i, it.Item().Key())
+			}
+			i++
+		}
+
+		if i != len(sorted) {
+			t.Errorf("unexpected number of keys: %d, expected %d", i, len(sorted))
+		}
+		return nil
+	})
+}
+
+// testStore runs the basic operations the state relies on against a store
+func testStore(t *testing.T, store Store) {
+	keys := [][]byte{{'a', 1}, {'a', 2}, {'a', 3}, {'b', 1}}
+
+	err := store.Update(func(txn Txn) error {
+		for _, k := range keys {
+			err := txn.Set(k, k)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := txn.SetWithMeta([]byte{'c', 1}, []byte("meta"), 5)
+		if err != nil {
+			return err
+		}
+
+		err = txn.SetWithMetaTTL([]byte{'c', 3}, []byte("meta ttl"), 6, time.Hour)
+		if err != nil {
+			return err
+		}
+
+		return txn.SetWithTTL([]byte{'c', 2}, []byte("expired"), -time.Second)
+	})
+	AssertFatal(t, err, "failed setting keys")
+
+	err = store.View(func(txn Txn) error {
+		item, err := txn.Get([]byte{'c', 1})
+		if err != nil {
+			return err
+		}
+
+		if item.UserMeta() != 5 {
+			t.Errorf("unexpected user meta: %d", item.UserMeta())
+		}
+
+		if v, _ := item.ValueCopy(nil); string(v) != "meta" {
+			t.Errorf("unexpected value: %q", v)
+		}
+
+		item, err = txn.Get([]byte{'c', 3})
+		if err != nil {
+			return err
+		}
+
+		if item.UserMeta() != 6 || item.ExpiresAt() == 0 {
+			t.Errorf("unexpected user meta or expiry: %d, %d", item.UserMeta(), item.ExpiresAt())
+		}
+
+		if _, err := txn.Get([]byte{'c', 2}); err != ErrNotFound {
+			t.Error("expected ErrNotFound for expired key, got: ", err)
+		}
+
+		if _, err := txn.Get([]byte{'d'}); err != ErrNotFound {
+			t.Error("expected ErrNotFound for missing key, got: ", err)
+		}
+
+		return nil
+	})
+	AssertFatal(t, err, "failed viewing")
+
+	// Iterate forwards and in reverse, deleting the keys as we go
+	err = store.Update(func(txn Txn) error {
+		n := 0
+		it := txn.NewIterator(DefaultIteratorOptions)
+		for it.Seek([]byte{'a'}); it.ValidForPrefix([]byte{'a'}); it.Next() {
+			n++
+			if it.Item().Key()[1] != byte(n) {
+				t.Errorf("unexpected key at %d: %v", n, it.Item().Key())
+			}
+		}
+		it.Close()
+
+		if n != 3 {
+			t.Errorf("unexpected number of keys iterated: %d", n)
+		}
+
+		opts := DefaultIteratorOptions
+		opts.Reverse = true
+
+		n = 0
+		it = txn.NewIterator(opts)
+		for it.Seek([]byte{'a', 0xff}); it.ValidForPrefix([]byte{'a'}); it.Next() {
+			if it.Item().Key()[1] != byte(3-n) {
+				t.Errorf("unexpected key at %d in reverse: %v", n, it.Item().Key())
+			}
+			n++
+
+			err := txn.Delete(append([]byte{}, it.Item().Key()...))
+			if err != nil {
+				return err
+			}
+		}
+		it.Close()
+
+		if n != 3 {
+			t.Errorf("unexpected number of keys iterated in reverse: %d", n)
+		}
+
+		return nil
+	})
+	AssertFatal(t, err, "failed iterating")
+
+	err = store.View(func(txn Txn) error {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+
+		it.Rewind()
+		if !it.Valid() || it.Item().Key()[0] != 'b' {
+			t.Error("deleted keys still there")
+		}
+		return nil
+	})
+	AssertFatal(t, err, "failed viewing after deletes")
+}
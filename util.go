@@ -2,8 +2,6 @@ package dbstate
 
 import (
 	"bytes"
-	"github.com/dgraph-io/badger"
-	"github.com/json-iterator/go"
 	"github.com/pkg/errors"
 	"sync"
 	"time"
@@ -13,29 +11,32 @@ type MessageFlag byte
 
 const (
 	MessageFlagDeleted MessageFlag = 1 << iota
+
+	// Set together with MessageFlagDeleted when the message was deleted in a bulk delete (e.g a purge)
+	MessageFlagBulkDeleted
 )
 
 // setKey is a helper to encode and set a get using the provided shards encoder and buffer
 // If tx is nil, will create a new transaction
-func (w *shardWorker) setKey(txn *badger.Txn, key []byte, val interface{}) error {
+func (w *shardWorker) setKey(txn Txn, key []byte, val interface{}) error {
 	return w.State.SetKey(txn, w.buffer, w.encoder, key, val)
 }
 
-func (w *shardWorker) setKeyWithMeta(txn *badger.Txn, key []byte, val interface{}, meta byte) error {
+func (w *shardWorker) setKeyWithMeta(txn Txn, key []byte, val interface{}, meta byte) error {
 	return w.State.SetKeyWithMeta(txn, w.buffer, w.encoder, key, val, meta)
 }
 
-func (w *shardWorker) setKeyWithTTL(txn *badger.Txn, key []byte, val interface{}, ttl time.Duration) error {
+func (w *shardWorker) setKeyWithTTL(txn Txn, key []byte, val interface{}, ttl time.Duration) error {
 	return w.State.SetKeyWithTTL(txn, w.buffer, w.encoder, key, val, ttl)
 }
 
-func (s *State) SetKey(txn *badger.Txn, buffer *bytes.Buffer, encoder *jsoniter.Encoder, key []byte, val interface{}) error {
+func (s *State) SetKey(txn Txn, buffer *bytes.Buffer, encoder Encoder, key []byte, val interface{}) error {
 	return s.SetKeyWithTTL(txn, buffer, encoder, key, val, -1)
 }
 
-func (s *State) SetKeyWithTTL(tx *badger.Txn, buffer *bytes.Buffer, encoder *jsoniter.Encoder, key []byte, val interface{}, ttl time.Duration) error {
+func (s *State) SetKeyWithTTL(tx Txn, buffer *bytes.Buffer, encoder Encoder, key []byte, val interface{}, ttl time.Duration) error {
 	if tx == nil {
-		return s.RetryUpdate(func(txn *badger.Txn) error {
+		return s.RetryUpdate(func(txn Txn) error {
 			return s.SetKeyWithTTL(txn, buffer, encoder, key, val, ttl)
 		})
 	}
@@ -58,9 +59,9 @@ func (s *State) SetKeyWithTTL(tx *badger.Txn, buffer *bytes.Buffer, encoder *jso
 	return err
 }
 
-func (s *State) SetKeyWithMeta(tx *badger.Txn, buffer *bytes.Buffer, encoder *jsoniter.Encoder, key []byte, val interface{}, meta byte) error {
+func (s *State) SetKeyWithMeta(tx Txn, buffer *bytes.Buffer, encoder Encoder, key []byte, val interface{}, meta byte) error {
 	if tx == nil {
-		return s.RetryUpdate(func(txn *badger.Txn) error {
+		return s.RetryUpdate(func(txn Txn) error {
 			return s.SetKeyWithMeta(txn, buffer, encoder, key, val, meta)
 		})
 	}
@@ -78,12 +79,12 @@ func (s *State) SetKeyWithMeta(tx *badger.Txn, buffer *bytes.Buffer, encoder *js
 	return err
 }
 
-// encodeData encodes the provided value using the provided shards buffer and encoder
+// encodeData encodes the provided value with the codec using the provided shards buffer and encoder
 // the returned byte slice is only valid until the next modification of buffer
-func (s *State) encodeData(buffer *bytes.Buffer, enc *jsoniter.Encoder, val interface{}) ([]byte, error) {
+func (s *State) encodeData(buffer *bytes.Buffer, enc Encoder, val interface{}) ([]byte, error) {
 	if buffer == nil || enc == nil {
 		buffer = new(bytes.Buffer)
-		enc = jsoniter.NewEncoder(buffer)
+		enc = s.opts.Codec.NewEncoder(buffer)
 	}
 
 	err := enc.Encode(val)
@@ -102,9 +103,9 @@ func (s *State) encodeData(buffer *bytes.Buffer, enc *jsoniter.Encoder, val inte
 
 // GetKey is a helper for retrieving a key and decoding it into the destination
 // If tx is nil, will create a new transaction
-func (s *State) GetKey(txn *badger.Txn, key []byte, dest interface{}) (item *badger.Item, err error) {
+func (s *State) GetKey(txn Txn, key []byte, dest interface{}) (item Item, err error) {
 	if txn == nil {
-		err = s.DB.View(func(txn *badger.Txn) error {
+		err = s.Store.View(func(txn Txn) error {
 			item, err = s.GetKey(txn, key, dest)
 			return err
 		})
@@ -117,9 +118,7 @@ func (s *State) GetKey(txn *badger.Txn, key []byte, dest interface{}) (item *bad
 		return
 	}
 
-	buf := make([]byte, item.EstimatedSize())
-
-	v, err := item.ValueCopy(buf)
+	v, err := item.ValueCopy(nil)
 	if err != nil {
 		return
 	}
@@ -130,9 +129,9 @@ func (s *State) GetKey(txn *badger.Txn, key []byte, dest interface{}) (item *bad
 
 // GetKeyWithBuffer is the same as GetKey but allows you to reuse the buffer
 // The buffer may need to grow, in which case it will return a new one
-func (s *State) GetKeyWithBuffer(txn *badger.Txn, key []byte, buffer []byte, dest interface{}) (item *badger.Item, newBuffer []byte, err error) {
+func (s *State) GetKeyWithBuffer(txn Txn, key []byte, buffer []byte, dest interface{}) (item Item, newBuffer []byte, err error) {
 	if txn == nil {
-		err = s.DB.View(func(txn *badger.Txn) error {
+		err = s.Store.View(func(txn Txn) error {
 			item, buffer, err = s.GetKeyWithBuffer(txn, key, buffer, dest)
 			return err
 		})
@@ -154,22 +153,22 @@ func (s *State) GetKeyWithBuffer(txn *badger.Txn, key []byte, buffer []byte, des
 	return item, v, err
 }
 
-// DecodeData is a helper for deocding data
+// DecodeData is a helper for deocding data using the codec
 func (s *State) DecodeData(data []byte, dest interface{}) error {
-	err := jsoniter.Unmarshal(data, dest)
+	err := s.opts.Codec.Decode(data, dest)
 	return err
 }
 
-// RetryUpdate will run s.DB.Update with `fn` and re-run it if ErrConflict is returned, until no there are no conflicts
+// RetryUpdate will run s.Store.Update with `fn` and re-run it if ErrConflict is returned, until no there are no conflicts
 // therefor `fn` may be called multiple times, but each time there is a conflict writes are thrown away
-func (s *State) RetryUpdate(fn func(txn *badger.Txn) error) error {
+func (s *State) RetryUpdate(fn func(txn Txn) error) error {
 	for {
-		err := s.DB.Update(fn)
+		err := s.Store.Update(fn)
 		if err == nil {
 			return nil
 		}
 
-		if err == badger.ErrConflict {
+		if err == ErrConflict {
 			s.opts.Logger.LogWarn("Transaction conflict, retrying...")
 			time.Sleep(time.Millisecond)
 			continue
@@ -185,6 +184,13 @@ type presenceUpdateFilter struct {
 	mu                               sync.RWMutex
 }
 
+// newPresenceUpdateFilter returns a cleared filter, so that it can be used before the first gc tick
+func newPresenceUpdateFilter(numShards int) *presenceUpdateFilter {
+	f := &presenceUpdateFilter{numShards: numShards}
+	f.clear()
+	return f
+}
+
 func (f *presenceUpdateFilter) clear() {
 	f.mu.Lock()
 	f.recentlyProcessedPresenceUpdates = make([][]string, f.numShards)
@@ -212,8 +218,90 @@ func (f *presenceUpdateFilter) checkUserID(shardID int, userID string) (checkedR
 	return false
 }
 
+// countKeysWithPrefix returns the number of keys with the prefix without retrieving the values
+func countKeysWithPrefix(txn Txn, prefix []byte) int {
+	n := 0
+
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		n++
+	}
+
+	return n
+}
+
+// deleteKeysWithPrefix deletes all the keys with the prefix in the transaction
+func deleteKeysWithPrefix(txn Txn, prefix []byte) error {
+	_, err := deleteKeysWithPrefixLimit(txn, prefix, -1)
+	return err
+}
+
+// deleteKeysWithPrefixLimit deletes up to limit keys with the prefix in the transaction, if limit < 0 then there's no limit
+func deleteKeysWithPrefixLimit(txn Txn, prefix []byte, limit int) (n int, err error) {
+	var keys [][]byte
+
+	opts := DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if limit >= 0 && len(keys) >= limit {
+			break
+		}
+
+		key := it.Item().Key()
+		cop := make([]byte, len(key))
+		copy(cop, key)
+		keys = append(keys, cop)
+	}
+	it.Close()
+
+	for _, k := range keys {
+		err := txn.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+// deleteKeysWithPrefixBatched deletes all the keys with the prefix using multiple transactions to avoid going above the tx limit
+func (s *State) deleteKeysWithPrefixBatched(prefix []byte) error {
+	for {
+		n := 0
+		err := s.RetryUpdate(func(txn Txn) error {
+			var err error
+			n, err = deleteKeysWithPrefixLimit(txn, prefix, 1000)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if n < 1000 {
+			return nil
+		}
+	}
+}
+
+// DiscordEpoch is the discord epoch in unix milliseconds, the timestamps in snowflakes are relative to this
+const DiscordEpoch = 1420070400000
+
+// SnowflakeFromTime returns the lowest snowflake that can be created at t, all snowflakes created at or after t are >= to it
+func SnowflakeFromTime(t time.Time) uint64 {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if ms <= DiscordEpoch {
+		return 0
+	}
+
+	return uint64(ms-DiscordEpoch) << 22
+}
+
 // IsNotFound returns true if the error was a result of the object/key not being found
-// errors may change in the future so using this is preferred over checking against badger.ErrKeyNotFound manually
+// errors may change in the future so using this is preferred over checking against ErrNotFound manually
 func IsNotFound(err error) bool {
-	return err == badger.ErrKeyNotFound || err == ErrNotFound
+	return err == ErrNotFound
 }